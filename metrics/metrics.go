@@ -3,99 +3,224 @@ package metrics
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 
 	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
-	"go.opentelemetry.io/otel/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
 )
 
 const instrumName = "opentelemetry/otel"
 
 type config struct {
-	tracerProvider trace.TracerProvider
-	tracer         trace.Tracer
-
 	meterProvider metric.MeterProvider
-	meter         metric.Meter
+	scopeName     string
+	scopeVersion  string
+
+	attrs []attribute.KeyValue
+	opts  []metric.ObserveOption
+
+	legacy       bool
+	semconv      bool
+	poolName     string
+	maxIdleConns int
+}
+
+// Option configures the DBStats metrics.
+type Option func(c *config)
+
+// WithMeterProvider configures the meter provider used to create the instruments,
+// otel.GetMeterProvider() is used by default.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = provider
+	}
+}
+
+// WithAttributes adds attributes to all observations, e.g. to tell databases apart.
+func WithAttributes(attrs ...attribute.KeyValue) Option {
+	return func(c *config) {
+		c.attrs = append(c.attrs, attrs...)
+	}
+}
+
+// WithObserveOptions adds options to all observations.
+func WithObserveOptions(opts ...metric.ObserveOption) Option {
+	return func(c *config) {
+		c.opts = append(c.opts, opts...)
+	}
+}
+
+// WithInstrumentationScope sets the name and version of the meter's instrumentation scope.
+func WithInstrumentationScope(name, version string) Option {
+	return func(c *config) {
+		c.scopeName = name
+		c.scopeVersion = version
+	}
+}
 
-	opts []metric.ObserveOption
+// WithSemconvMetrics reports the db.client.connection.count (by idle and used state),
+// db.client.connection.max and, with WithMaxIdleConns, db.client.connection.idle.max
+// metrics of the OpenTelemetry semantic conventions, in addition to the
+// go.sql.connections_* ones. The wait_time, use_time and create_time histograms and
+// the timeouts counter cannot be derived from DBStats, they are reported by
+// PoolMetrics, see tracing.WithPoolMetrics.
+func WithSemconvMetrics() Option {
+	return func(c *config) {
+		c.semconv = true
+	}
 }
 
-func newConfig() *config {
+// WithoutLegacyMetrics stops reporting the go.sql.connections_* metrics, once
+// dashboards and alerts have moved to the semantic convention metrics.
+func WithoutLegacyMetrics() Option {
+	return func(c *config) {
+		c.legacy = false
+	}
+}
+
+// WithPoolName sets the db.client.connection.pool.name attribute of the semantic
+// convention metrics, which should be unique within the application.
+func WithPoolName(name string) Option {
+	return func(c *config) {
+		c.poolName = name
+	}
+}
+
+// WithMaxIdleConns reports n as db.client.connection.idle.max. database/sql does not
+// expose the value given to SetMaxIdleConns, so it is only reported when set here.
+func WithMaxIdleConns(n int) Option {
+	return func(c *config) {
+		c.maxIdleConns = n
+	}
+}
+
+func newConfig(opts []Option) *config {
 	c := &config{
-		tracerProvider: otel.GetTracerProvider(),
-		meterProvider:  otel.GetMeterProvider(),
-		tracer:         nil,
-		meter:          nil,
-		opts:           nil,
+		meterProvider: otel.GetMeterProvider(),
+		scopeName:     instrumName,
+		legacy:        true,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.meterProvider == nil {
+		c.meterProvider = otel.GetMeterProvider()
 	}
 	return c
 }
 
+func (c *config) meter() metric.Meter {
+	var opts []metric.MeterOption
+	if c.scopeVersion != "" {
+		opts = append(opts, metric.WithInstrumentationVersion(c.scopeVersion))
+	}
+	return c.meterProvider.Meter(c.scopeName, opts...)
+}
+
+func (c *config) observeOptions(extra ...attribute.KeyValue) []metric.ObserveOption {
+	opts := append([]metric.ObserveOption(nil), c.opts...)
+	if attrs := append(append([]attribute.KeyValue(nil), c.attrs...), extra...); len(attrs) > 0 {
+		opts = append(opts, metric.WithAttributes(attrs...))
+	}
+	return opts
+}
+
 // ReportDBStatsMetrics reports DBStats metrics using OpenTelemetry Metrics API.
-func ReportDBStatsMetrics(db *sql.DB, opts ...metric.ObserveOption) {
-	cfg := newConfig()
+// The returned registration must be unregistered once db is closed, otherwise
+// the metrics keep observing the closed pool.
+func ReportDBStatsMetrics(db *sql.DB, opts ...Option) (metric.Registration, error) {
+	cfg := newConfig(opts)
+	meter := cfg.meter()
 
-	if cfg.meter == nil {
-		cfg.meter = cfg.meterProvider.Meter(instrumName)
+	var (
+		instruments []metric.Observable
+		observers   []func(o metric.Observer, stats sql.DBStats)
+		errs        []error
+	)
+	if cfg.legacy {
+		ins, observe, err := legacyInstruments(meter, cfg.observeOptions())
+		instruments, observers, errs = append(instruments, ins...), append(observers, observe), append(errs, err)
+	}
+	if cfg.semconv {
+		ins, observe, err := semconvInstruments(meter, cfg)
+		instruments, observers, errs = append(instruments, ins...), append(observers, observe), append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("create DBStats instruments failed: %w", err)
 	}
 
-	meter := cfg.meter
-	opts = append(cfg.opts, opts...)
+	reg, err := meter.RegisterCallback(
+		func(ctx context.Context, o metric.Observer) error {
+			stats := db.Stats()
+			for _, observe := range observers {
+				observe(o, stats)
+			}
+			return nil
+		},
+		instruments...,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("register DBStats callback failed: %w", err)
+	}
+	return reg, nil
+}
+
+// legacyInstruments are the go.sql.connections_* metrics.
+func legacyInstruments(meter metric.Meter, opts []metric.ObserveOption) ([]metric.Observable, func(metric.Observer, sql.DBStats), error) {
+	var errs []error
+	int64Gauge := func(name, description string) metric.Int64ObservableGauge {
+		gauge, err := meter.Int64ObservableGauge(name, metric.WithDescription(description))
+		errs = append(errs, err)
+		return gauge
+	}
+	int64Counter := func(name, description string, opts ...metric.Int64ObservableCounterOption) metric.Int64ObservableCounter {
+		counter, err := meter.Int64ObservableCounter(name, append(opts, metric.WithDescription(description))...)
+		errs = append(errs, err)
+		return counter
+	}
 
-	maxOpenConns, _ := meter.Int64ObservableGauge(
+	maxOpenConns := int64Gauge(
 		"go.sql.connections_max_open",
-		metric.WithDescription("Maximum number of open connections to the database"),
+		"Maximum number of open connections to the database",
 	)
-	openConns, _ := meter.Int64ObservableGauge(
+	openConns := int64Gauge(
 		"go.sql.connections_open",
-		metric.WithDescription("The number of established connections both in use and idle"),
+		"The number of established connections both in use and idle",
 	)
-	inUseConns, _ := meter.Int64ObservableGauge(
+	inUseConns := int64Gauge(
 		"go.sql.connections_in_use",
-		metric.WithDescription("The number of connections currently in use"),
+		"The number of connections currently in use",
 	)
-	idleConns, _ := meter.Int64ObservableGauge(
+	idleConns := int64Gauge(
 		"go.sql.connections_idle",
-		metric.WithDescription("The number of idle connections"),
+		"The number of idle connections",
 	)
-	connsWaitCount, _ := meter.Int64ObservableCounter(
+	connsWaitCount := int64Counter(
 		"go.sql.connections_wait_count",
-		metric.WithDescription("The total number of connections waited for"),
+		"The total number of connections waited for",
 	)
-	connsWaitDuration, _ := meter.Int64ObservableCounter(
+	connsWaitDuration := int64Counter(
 		"go.sql.connections_wait_duration",
-		metric.WithDescription("The total time blocked waiting for a new connection"),
+		"The total time blocked waiting for a new connection",
 		metric.WithUnit("nanoseconds"),
 	)
-	connsClosedMaxIdle, _ := meter.Int64ObservableCounter(
+	connsClosedMaxIdle := int64Counter(
 		"go.sql.connections_closed_max_idle",
-		metric.WithDescription("The total number of connections closed due to SetMaxIdleConns"),
+		"The total number of connections closed due to SetMaxIdleConns",
 	)
-	connsClosedMaxIdleTime, _ := meter.Int64ObservableCounter(
+	connsClosedMaxIdleTime := int64Counter(
 		"go.sql.connections_closed_max_idle_time",
-		metric.WithDescription("The total number of connections closed due to SetConnMaxIdleTime"),
+		"The total number of connections closed due to SetConnMaxIdleTime",
 	)
-	connsClosedMaxLifetime, _ := meter.Int64ObservableCounter(
+	connsClosedMaxLifetime := int64Counter(
 		"go.sql.connections_closed_max_lifetime",
-		metric.WithDescription("The total number of connections closed due to SetConnMaxLifetime"),
+		"The total number of connections closed due to SetConnMaxLifetime",
 	)
 
-	_, err := meter.RegisterCallback(
-		func(ctx context.Context, o metric.Observer) error {
-			stats := db.Stats()
-
-			o.ObserveInt64(maxOpenConns, int64(stats.MaxOpenConnections), opts...)
-			o.ObserveInt64(openConns, int64(stats.OpenConnections), opts...)
-			o.ObserveInt64(inUseConns, int64(stats.InUse), opts...)
-			o.ObserveInt64(idleConns, int64(stats.Idle), opts...)
-			o.ObserveInt64(connsWaitCount, stats.WaitCount, opts...)
-			o.ObserveInt64(connsWaitDuration, int64(stats.WaitDuration), opts...)
-			o.ObserveInt64(connsClosedMaxIdle, stats.MaxIdleClosed, opts...)
-			o.ObserveInt64(connsClosedMaxIdleTime, stats.MaxIdleTimeClosed, opts...)
-			o.ObserveInt64(connsClosedMaxLifetime, stats.MaxLifetimeClosed, opts...)
-			return nil
-		},
+	instruments := []metric.Observable{
 		maxOpenConns,
 		openConns,
 		inUseConns,
@@ -105,8 +230,69 @@ func ReportDBStatsMetrics(db *sql.DB, opts ...metric.ObserveOption) {
 		connsClosedMaxIdle,
 		connsClosedMaxIdleTime,
 		connsClosedMaxLifetime,
+	}
+	observe := func(o metric.Observer, stats sql.DBStats) {
+		o.ObserveInt64(maxOpenConns, int64(stats.MaxOpenConnections), opts...)
+		o.ObserveInt64(openConns, int64(stats.OpenConnections), opts...)
+		o.ObserveInt64(inUseConns, int64(stats.InUse), opts...)
+		o.ObserveInt64(idleConns, int64(stats.Idle), opts...)
+		o.ObserveInt64(connsWaitCount, stats.WaitCount, opts...)
+		o.ObserveInt64(connsWaitDuration, int64(stats.WaitDuration), opts...)
+		o.ObserveInt64(connsClosedMaxIdle, stats.MaxIdleClosed, opts...)
+		o.ObserveInt64(connsClosedMaxIdleTime, stats.MaxIdleTimeClosed, opts...)
+		o.ObserveInt64(connsClosedMaxLifetime, stats.MaxLifetimeClosed, opts...)
+	}
+	return instruments, observe, errors.Join(errs...)
+}
+
+// semconvInstruments are the db.client.connection.* metrics that can be derived from DBStats.
+// db.client.connection.wait_time and db.client.connection.timeouts are measured
+// per acquisition and cannot be derived from the cumulative DBStats.
+func semconvInstruments(meter metric.Meter, cfg *config) ([]metric.Observable, func(metric.Observer, sql.DBStats), error) {
+	var errs []error
+	upDownCounter := func(name, description, unit string) metric.Int64ObservableUpDownCounter {
+		counter, err := meter.Int64ObservableUpDownCounter(name, metric.WithDescription(description), metric.WithUnit(unit))
+		errs = append(errs, err)
+		return counter
+	}
+
+	count := upDownCounter(
+		semconv.DBClientConnectionCountName,
+		semconv.DBClientConnectionCountDescription,
+		semconv.DBClientConnectionCountUnit,
 	)
-	if err != nil {
-		panic(err)
+	maxConns := upDownCounter(
+		semconv.DBClientConnectionMaxName,
+		semconv.DBClientConnectionMaxDescription,
+		semconv.DBClientConnectionMaxUnit,
+	)
+	instruments := []metric.Observable{count, maxConns}
+
+	var idleMax metric.Int64ObservableUpDownCounter
+	if cfg.maxIdleConns > 0 {
+		idleMax = upDownCounter(
+			semconv.DBClientConnectionIdleMaxName,
+			semconv.DBClientConnectionIdleMaxDescription,
+			semconv.DBClientConnectionIdleMaxUnit,
+		)
+		instruments = append(instruments, idleMax)
+	}
+
+	var pool []attribute.KeyValue
+	if cfg.poolName != "" {
+		pool = []attribute.KeyValue{semconv.DBClientConnectionPoolName(cfg.poolName)}
+	}
+	opts := cfg.observeOptions(pool...)
+	idleOpts := cfg.observeOptions(append(pool, semconv.DBClientConnectionStateIdle)...)
+	usedOpts := cfg.observeOptions(append(pool, semconv.DBClientConnectionStateUsed)...)
+
+	observe := func(o metric.Observer, stats sql.DBStats) {
+		o.ObserveInt64(count, int64(stats.Idle), idleOpts...)
+		o.ObserveInt64(count, int64(stats.InUse), usedOpts...)
+		o.ObserveInt64(maxConns, int64(stats.MaxOpenConnections), opts...)
+		if idleMax != nil {
+			o.ObserveInt64(idleMax, int64(cfg.maxIdleConns), opts...)
+		}
 	}
+	return instruments, observe, errors.Join(errs...)
 }
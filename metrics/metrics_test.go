@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+type testConnector struct{}
+
+func (testConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (testConnector) Driver() driver.Driver { return nil }
+
+func TestReportDBStatsMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	db := sql.OpenDB(testConnector{})
+	db.SetMaxOpenConns(7)
+	defer db.Close()
+
+	reg, err := ReportDBStatsMetrics(db,
+		WithMeterProvider(provider),
+		WithAttributes(attribute.String("db.name", "test")),
+		WithInstrumentationScope("test/scope", "v1.2.3"),
+	)
+	require.NoError(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Equal(t, 1, len(rm.ScopeMetrics))
+	require.Equal(t, "test/scope", rm.ScopeMetrics[0].Scope.Name)
+	require.Equal(t, "v1.2.3", rm.ScopeMetrics[0].Scope.Version)
+
+	m, ok := findMetric(rm, "go.sql.connections_max_open")
+	require.True(t, ok)
+	point := m.Data.(metricdata.Gauge[int64]).DataPoints[0]
+	require.Equal(t, int64(7), point.Value)
+	name, _ := point.Attributes.Value("db.name")
+	require.Equal(t, "test", name.AsString())
+
+	require.NoError(t, reg.Unregister())
+	rm = metricdata.ResourceMetrics{}
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	_, ok = findMetric(rm, "go.sql.connections_max_open")
+	require.False(t, ok)
+}
+
+func TestSemconvMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	db := sql.OpenDB(testConnector{})
+	db.SetMaxOpenConns(7)
+	db.SetMaxIdleConns(3)
+	defer db.Close()
+
+	_, err := ReportDBStatsMetrics(db,
+		WithMeterProvider(provider),
+		WithSemconvMetrics(),
+		WithoutLegacyMetrics(),
+		WithPoolName("primary"),
+		WithMaxIdleConns(3),
+	)
+	require.NoError(t, err)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Equal(t, 3, len(rm.ScopeMetrics[0].Metrics))
+	_, ok := findMetric(rm, "go.sql.connections_max_open")
+	require.False(t, ok)
+
+	m, ok := findMetric(rm, "db.client.connection.count")
+	require.True(t, ok)
+	require.Equal(t, "{connection}", m.Unit)
+	points := m.Data.(metricdata.Sum[int64]).DataPoints
+	require.Equal(t, 2, len(points))
+	for _, point := range points {
+		state, _ := point.Attributes.Value("db.client.connection.state")
+		require.Contains(t, []string{"idle", "used"}, state.AsString())
+		pool, _ := point.Attributes.Value("db.client.connection.pool.name")
+		require.Equal(t, "primary", pool.AsString())
+	}
+
+	m, ok = findMetric(rm, "db.client.connection.max")
+	require.True(t, ok)
+	require.Equal(t, int64(7), m.Data.(metricdata.Sum[int64]).DataPoints[0].Value)
+
+	m, ok = findMetric(rm, "db.client.connection.idle.max")
+	require.True(t, ok)
+	require.Equal(t, int64(3), m.Data.(metricdata.Sum[int64]).DataPoints[0].Value)
+}
+
+func findMetric(rm metricdata.ResourceMetrics, name string) (metricdata.Metrics, bool) {
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m, true
+			}
+		}
+	}
+	return metricdata.Metrics{}, false
+}
+
+func TestViews(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithView(Views()...))
+	meter := provider.Meter("test")
+
+	// instruments without advice get the boundaries from the views
+	duration, err := meter.Float64Histogram("db.client.operation.duration")
+	require.NoError(t, err)
+	duration.Record(context.Background(), 0.0002)
+	rows, err := meter.Int64Histogram("db.client.response.returned_rows")
+	require.NoError(t, err)
+	rows.Record(context.Background(), 3)
+	other, err := meter.Float64Histogram("other")
+	require.NoError(t, err)
+	other.Record(context.Background(), 1)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	m, ok := findMetric(rm, "db.client.operation.duration")
+	require.True(t, ok)
+	dp := m.Data.(metricdata.Histogram[float64]).DataPoints[0]
+	require.Equal(t, DurationBoundaries, dp.Bounds)
+	require.Equal(t, uint64(1), dp.BucketCounts[1])
+
+	m, ok = findMetric(rm, "db.client.response.returned_rows")
+	require.True(t, ok)
+	require.Equal(t, RowBoundaries, m.Data.(metricdata.Histogram[int64]).DataPoints[0].Bounds)
+
+	m, ok = findMetric(rm, "other")
+	require.True(t, ok)
+	require.NotEqual(t, DurationBoundaries, m.Data.(metricdata.Histogram[float64]).DataPoints[0].Bounds)
+}
@@ -0,0 +1,182 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+)
+
+// PoolMetrics measures the connections of a pool one acquisition at a time,
+// which the cumulative DBStats cannot: it reports the db.client.connection.wait_time,
+// use_time and create_time histograms, the db.client.connection.timeouts counter
+// and the db.client.connection.pending_requests gauge. It also reports the
+// transactions of the pool, see StartTx.
+//
+// Connections must be acquired with Conn to be measured, and the connector of
+// the pool must be wrapped with Connector for create_time.
+type PoolMetrics struct {
+	waitTime   metric.Float64Histogram
+	useTime    metric.Float64Histogram
+	createTime metric.Float64Histogram
+	timeouts   metric.Int64Counter
+	pending    metric.Int64UpDownCounter
+
+	txDuration metric.Float64Histogram
+	txCount    metric.Int64Counter
+	txOpen     metric.Int64UpDownCounter
+
+	opts       metric.MeasurementOption
+	txOutcomes map[string]metric.MeasurementOption
+}
+
+// NewPoolMetrics creates the per-acquisition pool instruments. WithPoolName should
+// be set to tell pools apart.
+func NewPoolMetrics(opts ...Option) (*PoolMetrics, error) {
+	cfg := newConfig(opts)
+	meter := cfg.meter()
+
+	var errs []error
+	histogram := func(name, description, unit string) metric.Float64Histogram {
+		h, err := meter.Float64Histogram(
+			name,
+			metric.WithDescription(description),
+			metric.WithUnit(unit),
+			metric.WithExplicitBucketBoundaries(DurationBoundaries...),
+		)
+		errs = append(errs, err)
+		return h
+	}
+
+	m := &PoolMetrics{
+		waitTime: histogram(
+			semconv.DBClientConnectionWaitTimeName,
+			semconv.DBClientConnectionWaitTimeDescription,
+			semconv.DBClientConnectionWaitTimeUnit,
+		),
+		useTime: histogram(
+			semconv.DBClientConnectionUseTimeName,
+			semconv.DBClientConnectionUseTimeDescription,
+			semconv.DBClientConnectionUseTimeUnit,
+		),
+		createTime: histogram(
+			semconv.DBClientConnectionCreateTimeName,
+			semconv.DBClientConnectionCreateTimeDescription,
+			semconv.DBClientConnectionCreateTimeUnit,
+		),
+		txDuration: histogram(
+			txDurationName,
+			"The time between the start of a transaction and its commit or rollback",
+			"s",
+		),
+	}
+	var err error
+	m.timeouts, err = meter.Int64Counter(
+		semconv.DBClientConnectionTimeoutsName,
+		metric.WithDescription(semconv.DBClientConnectionTimeoutsDescription),
+		metric.WithUnit(semconv.DBClientConnectionTimeoutsUnit),
+	)
+	errs = append(errs, err)
+	m.pending, err = meter.Int64UpDownCounter(
+		semconv.DBClientConnectionPendingRequestsName,
+		metric.WithDescription(semconv.DBClientConnectionPendingRequestsDescription),
+		metric.WithUnit(semconv.DBClientConnectionPendingRequestsUnit),
+	)
+	errs = append(errs, err)
+	m.txCount, err = meter.Int64Counter(
+		"db.client.transactions",
+		metric.WithDescription("The number of ended transactions by db.transaction.outcome"),
+		metric.WithUnit("{transaction}"),
+	)
+	errs = append(errs, err)
+	m.txOpen, err = meter.Int64UpDownCounter(
+		"db.client.transaction.open",
+		metric.WithDescription("The number of transactions currently open"),
+		metric.WithUnit("{transaction}"),
+	)
+	errs = append(errs, err)
+	if err := errors.Join(errs...); err != nil {
+		return nil, fmt.Errorf("create pool instruments failed: %w", err)
+	}
+
+	attrs := append([]attribute.KeyValue(nil), cfg.attrs...)
+	if cfg.poolName != "" {
+		attrs = append(attrs, semconv.DBClientConnectionPoolName(cfg.poolName))
+	}
+	m.opts = metric.WithAttributeSet(attribute.NewSet(attrs...))
+	m.txOutcomes = make(map[string]metric.MeasurementOption)
+	for _, outcome := range []string{TxCommit, TxRollback, TxError} {
+		m.txOutcomes[outcome] = metric.WithAttributeSet(attribute.NewSet(append(attrs, txOutcome.String(outcome))...))
+	}
+	return m, nil
+}
+
+// Conn is a connection acquired through PoolMetrics.Conn.
+type Conn struct {
+	*sql.Conn
+
+	m        *PoolMetrics
+	acquired time.Time
+}
+
+// Conn acquires a connection from db and records the time it took, the request
+// is counted as pending meanwhile. Acquisitions that hit the deadline of ctx are
+// counted as timeouts.
+func (m *PoolMetrics) Conn(ctx context.Context, db *sql.DB) (*Conn, error) {
+	m.pending.Add(ctx, 1, m.opts)
+	start := time.Now()
+	conn, err := db.Conn(ctx)
+	acquired := time.Now()
+	m.pending.Add(ctx, -1, m.opts)
+	m.waitTime.Record(ctx, acquired.Sub(start).Seconds(), m.opts)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			m.timeouts.Add(ctx, 1, m.opts)
+		}
+		return nil, err
+	}
+	return &Conn{Conn: conn, m: m, acquired: acquired}, nil
+}
+
+// Close returns the connection to the pool and records how long it was used.
+// Like sql.Conn.Close, it blocks until the rows and transactions of the connection are closed.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.m.useTime.Record(context.Background(), time.Since(c.acquired).Seconds(), c.m.opts)
+	return err
+}
+
+// Connector wraps c to record the time it takes to create connections,
+// use it with sql.OpenDB.
+func (m *PoolMetrics) Connector(c driver.Connector) driver.Connector {
+	return &connector{Connector: c, m: m}
+}
+
+type connector struct {
+	driver.Connector
+	m *PoolMetrics
+}
+
+func (c *connector) Connect(ctx context.Context) (driver.Conn, error) {
+	start := time.Now()
+	conn, err := c.Connector.Connect(ctx)
+	if err == nil {
+		c.m.createTime.Record(ctx, time.Since(start).Seconds(), c.m.opts)
+	}
+	return conn, err
+}
+
+// Close closes the wrapped connector if it implements io.Closer, as sql.DB.Close does.
+func (c *connector) Close() error {
+	if closer, ok := c.Connector.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
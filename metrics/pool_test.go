@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+type stubConnector struct{}
+
+func (stubConnector) Connect(context.Context) (driver.Conn, error) { return stubConn{}, nil }
+
+func (stubConnector) Driver() driver.Driver { return nil }
+
+type stubConn struct{}
+
+func (stubConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not implemented") }
+
+func (stubConn) Close() error { return nil }
+
+func (stubConn) Begin() (driver.Tx, error) { return nil, errors.New("not implemented") }
+
+func TestPoolMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	m, err := NewPoolMetrics(WithMeterProvider(provider), WithPoolName("primary"))
+	require.NoError(t, err)
+
+	db := sql.OpenDB(m.Connector(stubConnector{}))
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	conn, err := m.Conn(context.Background(), db)
+	require.NoError(t, err)
+
+	pending := func() int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		m, ok := findMetric(rm, "db.client.connection.pending_requests")
+		require.True(t, ok)
+		return m.Data.(metricdata.Sum[int64]).DataPoints[0].Value
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := m.Conn(ctx, db)
+		done <- err
+	}()
+	require.Eventually(t, func() bool { return pending() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+	require.Equal(t, int64(0), pending())
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = m.Conn(ctx, db)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NoError(t, conn.Close())
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+
+	waitTime, ok := findMetric(rm, "db.client.connection.wait_time")
+	require.True(t, ok)
+	require.Equal(t, "s", waitTime.Unit)
+	point := waitTime.Data.(metricdata.Histogram[float64]).DataPoints[0]
+	require.Equal(t, uint64(3), point.Count)
+	require.GreaterOrEqual(t, point.Sum, 0.01)
+	pool, _ := point.Attributes.Value("db.client.connection.pool.name")
+	require.Equal(t, "primary", pool.AsString())
+
+	for name, count := range map[string]uint64{
+		"db.client.connection.use_time":    1,
+		"db.client.connection.create_time": 1,
+	} {
+		m, ok := findMetric(rm, name)
+		require.True(t, ok, name)
+		require.Equal(t, count, m.Data.(metricdata.Histogram[float64]).DataPoints[0].Count, name)
+	}
+
+	timeouts, ok := findMetric(rm, "db.client.connection.timeouts")
+	require.True(t, ok)
+	require.Equal(t, int64(1), timeouts.Data.(metricdata.Sum[int64]).DataPoints[0].Value)
+}
+
+func TestTxMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	m, err := NewPoolMetrics(WithMeterProvider(provider))
+	require.NoError(t, err)
+
+	open := func() int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		m, ok := findMetric(rm, "db.client.transaction.open")
+		require.True(t, ok)
+		return m.Data.(metricdata.Sum[int64]).DataPoints[0].Value
+	}
+
+	committed := m.StartTx(context.Background())
+	failed := m.StartTx(context.Background())
+	require.Equal(t, int64(2), open())
+
+	committed.End(TxCommit, nil)
+	failed.End(TxCommit, errors.New("commit failed"))
+	// the rollback following a failed commit is not counted
+	failed.End(TxRollback, sql.ErrTxDone)
+	require.Equal(t, int64(0), open())
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	count, ok := findMetric(rm, "db.client.transactions")
+	require.True(t, ok)
+	outcomes := map[string]int64{}
+	for _, point := range count.Data.(metricdata.Sum[int64]).DataPoints {
+		outcome, _ := point.Attributes.Value("db.transaction.outcome")
+		outcomes[outcome.AsString()] = point.Value
+	}
+	require.Equal(t, map[string]int64{TxCommit: 1, TxError: 1}, outcomes)
+}
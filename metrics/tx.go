@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Transaction outcomes, the values of the db.transaction.outcome attribute.
+const (
+	TxCommit   = "commit"
+	TxRollback = "rollback"
+	TxError    = "error"
+)
+
+const txDurationName = "db.client.transaction.duration"
+
+var txOutcome = attribute.Key("db.transaction.outcome")
+
+// Tx tracks a transaction from its start until it is committed or rolled back.
+type Tx struct {
+	m     *PoolMetrics
+	ctx   context.Context
+	start time.Time
+	ended atomic.Bool
+}
+
+// StartTx counts a transaction as open until End is called.
+func (m *PoolMetrics) StartTx(ctx context.Context) *Tx {
+	m.txOpen.Add(ctx, 1, m.opts)
+	return &Tx{m: m, ctx: ctx, start: time.Now()}
+}
+
+// End records the duration and outcome of the transaction, which is TxError when
+// err is not nil. Only the first call is recorded, so that the rollback gorm
+// issues after a failed commit is not counted twice.
+func (t *Tx) End(outcome string, err error) {
+	if !t.ended.CompareAndSwap(false, true) {
+		return
+	}
+	if err != nil {
+		outcome = TxError
+	}
+	opts, ok := t.m.txOutcomes[outcome]
+	if !ok {
+		opts = t.m.txOutcomes[TxError]
+	}
+
+	// the transaction context may be canceled by now, keep its values only
+	ctx := context.WithoutCancel(t.ctx)
+	t.m.txOpen.Add(ctx, -1, t.m.opts)
+	t.m.txDuration.Record(ctx, time.Since(t.start).Seconds(), t.m.opts)
+	t.m.txCount.Add(ctx, 1, opts)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+)
+
+// DurationBoundaries are the explicit bucket boundaries, in seconds, of the DB
+// duration histograms: the semantic convention advice for db.client.operation.duration,
+// extended below a millisecond for fast in-memory and cache databases.
+var DurationBoundaries = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// RowBoundaries are the explicit bucket boundaries of the DB row count histograms,
+// following the semantic convention advice for db.client.response.returned_rows.
+var RowBoundaries = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+// durationHistograms are the names of the histograms measured in seconds.
+var durationHistograms = []string{
+	semconv.DBClientOperationDurationName,
+	semconv.DBClientConnectionWaitTimeName,
+	semconv.DBClientConnectionUseTimeName,
+	semconv.DBClientConnectionCreateTimeName,
+	txDurationName,
+}
+
+// rowHistograms are the names of the histograms counting rows.
+var rowHistograms = []string{
+	semconv.DBClientResponseReturnedRowsName,
+}
+
+// Views returns the views applying DurationBoundaries and RowBoundaries to the
+// DB histograms. The instruments already advise these boundaries, the views are
+// for readers that configure another default aggregation:
+//
+//	sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithView(metrics.Views()...))
+func Views() []sdkmetric.View {
+	views := make([]sdkmetric.View, 0, len(durationHistograms)+len(rowHistograms))
+	view := func(name string, boundaries []float64) sdkmetric.View {
+		return sdkmetric.NewView(
+			sdkmetric.Instrument{Name: name, Kind: sdkmetric.InstrumentKindHistogram},
+			sdkmetric.Stream{Aggregation: sdkmetric.AggregationExplicitBucketHistogram{Boundaries: boundaries}},
+		)
+	}
+	for _, name := range durationHistograms {
+		views = append(views, view(name, DurationBoundaries))
+	}
+	for _, name := range rowHistograms {
+		views = append(views, view(name, RowBoundaries))
+	}
+	return views
+}
@@ -0,0 +1,109 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// ErrQueryBudgetExceeded is the error of the statements refused because the QueryBudget
+// of their context is exhausted, when budget enforcement is enabled.
+var ErrQueryBudgetExceeded = errors.New("query budget exceeded")
+
+var (
+	dbBudgetQueries  = attribute.Key("db.query_budget.queries")
+	dbBudgetDuration = attribute.Key("db.query_budget.duration")
+	dbBudgetRows     = attribute.Key("db.query_budget.rows")
+	dbBudgetExceeded = attribute.Key("db.query_budget.exceeded")
+)
+
+// QueryBudget limits the database work done on behalf of a context.
+// A zero value for a limit means that it is not enforced.
+type QueryBudget struct {
+	MaxQueries  int64
+	MaxDuration time.Duration
+	MaxRows     int64
+}
+
+type queryBudgetKey struct{}
+
+type queryBudget struct {
+	limits QueryBudget
+
+	queries  atomic.Int64
+	duration atomic.Int64
+	rows     atomic.Int64
+}
+
+// ContextWithQueryBudget returns a copy of ctx that accounts every statement executed
+// with it against budget.
+func ContextWithQueryBudget(ctx context.Context, budget QueryBudget) context.Context {
+	return context.WithValue(ctx, queryBudgetKey{}, &queryBudget{limits: budget})
+}
+
+func queryBudgetFromContext(ctx context.Context) *queryBudget {
+	b, _ := ctx.Value(queryBudgetKey{}).(*queryBudget)
+	return b
+}
+
+// exceeded returns the limits of the budget that the given usage is over.
+func (b *queryBudget) exceeded(queries int64, duration time.Duration, rows int64) []string {
+	var exceeded []string
+	if b.limits.MaxQueries > 0 && queries > b.limits.MaxQueries {
+		exceeded = append(exceeded, "queries")
+	}
+	if b.limits.MaxDuration > 0 && duration > b.limits.MaxDuration {
+		exceeded = append(exceeded, "duration")
+	}
+	if b.limits.MaxRows > 0 && rows > b.limits.MaxRows {
+		exceeded = append(exceeded, "rows")
+	}
+	return exceeded
+}
+
+// startQueryBudget counts the statement against b. With enforcement enabled, the
+// statement is refused once the budget is exhausted: gorm skips the statements
+// whose tx.Error is set. The duration and rows of a statement are only known once
+// it ran, so the statement that exhausts them completes and the next one is refused.
+func (p *otelPlugin) startQueryBudget(tx *gorm.DB, b *queryBudget) {
+	queries := b.queries.Add(1)
+	if !p.enforceQueryBudget {
+		return
+	}
+	exceeded := b.exceeded(queries, time.Duration(b.duration.Load()), b.rows.Load())
+	if len(exceeded) > 0 {
+		tx.AddError(fmt.Errorf("%w: %s", ErrQueryBudgetExceeded, strings.Join(exceeded, ", ")))
+	}
+}
+
+// accountQueryBudget adds the duration and rows of the statement to b and
+// records the usage if the budget is exceeded.
+func (p *otelPlugin) accountQueryBudget(tx *gorm.DB, b *queryBudget, c contextWrapper) {
+	queries := b.queries.Load()
+	duration := time.Duration(b.duration.Add(int64(time.Since(c.start))))
+	rows := b.rows.Load()
+	if tx.Statement.RowsAffected > 0 {
+		rows = b.rows.Add(tx.Statement.RowsAffected)
+	}
+
+	exceeded := b.exceeded(queries, duration, rows)
+	if len(exceeded) == 0 {
+		return
+	}
+
+	usage := []attribute.KeyValue{
+		dbBudgetQueries.Int64(queries),
+		dbBudgetDuration.Float64(duration.Seconds()),
+		dbBudgetRows.Int64(rows),
+		dbBudgetExceeded.StringSlice(exceeded),
+	}
+	trace.SpanFromContext(c.Context).AddEvent("db.query_budget.exceeded", trace.WithAttributes(usage...))
+	trace.SpanFromContext(c.parent).SetAttributes(usage...)
+}
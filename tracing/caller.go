@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+)
+
+// maxCallerDepth bounds the stack walk looking for the application caller.
+const maxCallerDepth = 64
+
+// defaultCallerSkipPrefixes are the function name prefixes that never count as the
+// application caller of a statement: gorm, its drivers and the hooks of the plugin.
+var defaultCallerSkipPrefixes = []string{
+	"gorm.io/gorm.",
+	"gorm.io/gorm/",
+	"gorm.io/driver/",
+	"gorm.io/plugin/opentelemetry/tracing.(*otelPlugin).",
+	"gorm.io/plugin/opentelemetry/tracing.(*callerResolver).",
+}
+
+type callerFrame struct {
+	skip     bool
+	function string
+	file     string
+	line     int
+}
+
+type callerResolver struct {
+	skipPrefixes []string
+	frames       sync.Map // map[uintptr]callerFrame
+}
+
+func newCallerResolver(skipPrefixes []string) *callerResolver {
+	return &callerResolver{
+		skipPrefixes: append(append([]string{}, defaultCallerSkipPrefixes...), skipPrefixes...),
+	}
+}
+
+// attributes returns the code location of the first frame on the current stack
+// that does not belong to gorm, this plugin or a configured package.
+func (r *callerResolver) attributes() []attribute.KeyValue {
+	var pcs [maxCallerDepth]uintptr
+	n := runtime.Callers(3, pcs[:])
+	for _, pc := range pcs[:n] {
+		f := r.frame(pc)
+		if !f.skip {
+			return []attribute.KeyValue{
+				semconv.CodeFunctionName(f.function),
+				semconv.CodeFilePath(f.file),
+				semconv.CodeLineNumber(f.line),
+			}
+		}
+	}
+	return nil
+}
+
+func (r *callerResolver) frame(pc uintptr) callerFrame {
+	if f, ok := r.frames.Load(pc); ok {
+		return f.(callerFrame)
+	}
+
+	f := callerFrame{skip: true}
+	frames := runtime.CallersFrames([]uintptr{pc})
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" && !r.skipFunction(frame) {
+			f = callerFrame{function: frame.Function, file: frame.File, line: frame.Line}
+			break
+		}
+		if !more {
+			break
+		}
+	}
+
+	r.frames.Store(pc, f)
+	return f
+}
+
+func (r *callerResolver) skipFunction(frame runtime.Frame) bool {
+	for _, prefix := range r.skipPrefixes {
+		if strings.HasPrefix(frame.Function, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"slices"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+)
+
+// otherValue replaces the attribute values seen once the limit set with
+// WithMetricAttributeLimit is reached.
+const otherValue = "_other"
+
+// Names of the per-statement instruments, see WithoutMetricAttributes.
+const (
+	NPlusOneMetricName          = "db.client.n_plus_one"
+	SlowQueriesMetricName       = "db.client.slow_queries"
+	ErrorsMetricName            = "db.client.errors"
+	OperationDurationMetricName = semconv.DBClientOperationDurationName
+	ReturnedRowsMetricName      = semconv.DBClientResponseReturnedRowsName
+)
+
+// limitedAttributes are the attributes whose distinct values are bounded by the limiter.
+var limitedAttributes = []attribute.Key{
+	semconv.DBOperationNameKey,
+	semconv.DBCollectionNameKey,
+	dbQueryFingerprint,
+}
+
+// attributeLimiter bounds the number of distinct values of each attribute,
+// values seen after the limit is reached are reported as otherValue.
+type attributeLimiter struct {
+	limit int
+
+	mu   sync.RWMutex
+	seen map[attribute.Key]map[string]struct{}
+}
+
+func newAttributeLimiter(limit int) *attributeLimiter {
+	return &attributeLimiter{
+		limit: limit,
+		seen:  make(map[attribute.Key]map[string]struct{}),
+	}
+}
+
+func (l *attributeLimiter) value(key attribute.Key, value string) string {
+	l.mu.RLock()
+	_, ok := l.seen[key][value]
+	full := len(l.seen[key]) >= l.limit
+	l.mu.RUnlock()
+	if ok {
+		return value
+	}
+	if full {
+		return otherValue
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	values := l.seen[key]
+	if values == nil {
+		values = make(map[string]struct{})
+		l.seen[key] = values
+	}
+	if _, ok := values[value]; !ok {
+		if len(values) >= l.limit {
+			return otherValue
+		}
+		values[value] = struct{}{}
+	}
+	return value
+}
+
+// normalizeAttributes rewrites the table name, caps the distinct values and drops
+// the attributes excluded from instrument, in place.
+func (p *otelPlugin) normalizeAttributes(instrument string, attrs []attribute.KeyValue) []attribute.KeyValue {
+	for i, kv := range attrs {
+		if kv.Key == semconv.DBCollectionNameKey && p.tableName != nil {
+			kv = kv.Key.String(p.tableName(kv.Value.AsString()))
+		}
+		if p.attrLimiter != nil && slices.Contains(limitedAttributes, kv.Key) {
+			kv = kv.Key.String(p.attrLimiter.value(kv.Key, kv.Value.AsString()))
+		}
+		attrs[i] = kv
+	}
+
+	if drop := p.dropAttrs[instrument]; len(drop) > 0 {
+		attrs = slices.DeleteFunc(attrs, func(kv attribute.KeyValue) bool {
+			return slices.Contains(drop, kv.Key)
+		})
+	}
+	return attrs
+}
@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	gormClauseLimit      = attribute.Key("gorm.clause.limit")
+	gormClauseOffset     = attribute.Key("gorm.clause.offset")
+	gormClauseLocking    = attribute.Key("gorm.clause.locking")
+	gormClauseOnConflict = attribute.Key("gorm.clause.on_conflict")
+	gormClauseJoins      = attribute.Key("gorm.clause.joins")
+	gormClauseOrderBy    = attribute.Key("gorm.clause.order_by")
+	gormClauseWhereEmpty = attribute.Key("gorm.clause.where_empty")
+)
+
+// clauseAttributes describes the structured clauses gorm built the statement from.
+// Raw statements have no clauses and produce no attributes.
+func clauseAttributes(tx *gorm.DB) []attribute.KeyValue {
+	clauses := tx.Statement.Clauses
+	if len(clauses) == 0 {
+		return nil
+	}
+
+	var attrs []attribute.KeyValue
+	if c, ok := clauses["LIMIT"]; ok {
+		if limit, ok := c.Expression.(clause.Limit); ok {
+			if limit.Limit != nil && *limit.Limit >= 0 {
+				attrs = append(attrs, gormClauseLimit.Int(*limit.Limit))
+			}
+			if limit.Offset > 0 {
+				attrs = append(attrs, gormClauseOffset.Int(limit.Offset))
+			}
+		}
+	}
+
+	if c, ok := clauses["FOR"]; ok {
+		if locking, ok := c.Expression.(clause.Locking); ok && locking.Strength != "" {
+			attrs = append(attrs, gormClauseLocking.String(strings.ToLower(locking.Strength)))
+		}
+	}
+
+	if c, ok := clauses["ON CONFLICT"]; ok {
+		if onConflict, ok := c.Expression.(clause.OnConflict); ok {
+			switch {
+			case onConflict.DoNothing:
+				attrs = append(attrs, gormClauseOnConflict.String("do_nothing"))
+			case onConflict.UpdateAll:
+				attrs = append(attrs, gormClauseOnConflict.String("update_all"))
+			case len(onConflict.DoUpdates) > 0:
+				attrs = append(attrs, gormClauseOnConflict.String("do_update"))
+			}
+		}
+	}
+
+	if c, ok := clauses["FROM"]; ok {
+		if from, ok := c.Expression.(clause.From); ok && len(from.Joins) > 0 {
+			attrs = append(attrs, gormClauseJoins.Int(len(from.Joins)))
+		}
+	}
+
+	if slices.Contains(tx.Statement.BuildClauses, "ORDER BY") {
+		_, ok := clauses["ORDER BY"]
+		attrs = append(attrs, gormClauseOrderBy.Bool(ok))
+	}
+
+	if slices.Contains(tx.Statement.BuildClauses, "WHERE") {
+		where, ok := clauses["WHERE"].Expression.(clause.Where)
+		attrs = append(attrs, gormClauseWhereEmpty.Bool(!ok || len(where.Exprs) == 0))
+	}
+
+	return attrs
+}
@@ -0,0 +1,231 @@
+package tracing
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+
+	"gorm.io/gorm"
+
+	"gorm.io/plugin/opentelemetry/metrics"
+)
+
+// maxBadConnRetries mirrors the retries database/sql performs when a pooled
+// connection turns out to be broken.
+const maxBadConnRetries = 2
+
+// connPool wraps the *sql.DB of a gorm.DB so that the plugin can observe when
+// the connection used by a statement is acquired and released back to the pool.
+type connPool struct {
+	*sql.DB
+
+	metrics *metrics.PoolMetrics
+}
+
+// pooledConn is a connection acquired by connPool, a *sql.Conn or a *metrics.Conn.
+type pooledConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+	Close() error
+}
+
+// wrapConnPool installs a connPool in front of the *sql.DB of db. With PrepareStmt,
+// statements run through prepared *sql.Stmt that acquire their connection inside
+// database/sql, so only the transactions of a *gorm.PreparedStmtDB are observed.
+// Other connection pools are left untouched, with a warning.
+func (p *otelPlugin) wrapConnPool(db *gorm.DB) {
+	switch pool := db.ConnPool.(type) {
+	case *sql.DB:
+		wrapped := &connPool{DB: pool, metrics: p.poolMetrics}
+		db.ConnPool = wrapped
+		db.Statement.ConnPool = wrapped
+		return
+	case *gorm.PreparedStmtDB:
+		if sqlDB, ok := pool.ConnPool.(*sql.DB); ok {
+			pool.ConnPool = &connPool{DB: sqlDB, metrics: p.poolMetrics}
+			return
+		}
+	}
+	db.Logger.Warn(context.Background(), "otelgorm: unsupported connection pool %T, rows iteration spans and pool metrics are not recorded", db.ConnPool)
+}
+
+// GetDBConn implements gorm.GetDBConnector so that gorm.DB.DB keeps working.
+func (p *connPool) GetDBConn() (*sql.DB, error) {
+	return p.DB, nil
+}
+
+func (p *connPool) conn(ctx context.Context) (pooledConn, error) {
+	if p.metrics != nil {
+		return p.metrics.Conn(ctx, p.DB)
+	}
+	return p.DB.Conn(ctx)
+}
+
+// heldConn holds the connection of a Query, Create, Update or Delete statement.
+// gorm closes the rows of these statements before the after hook runs, which then
+// returns the connection to the pool without waiting for it in a goroutine.
+type heldConn struct {
+	conn io.Closer
+}
+
+func (h *heldConn) release() {
+	if h.conn != nil {
+		_ = h.conn.Close()
+		h.conn = nil
+	}
+}
+
+// release returns conn to the pool once the rows read from it are closed, which
+// database/sql waits for in Close. The connection is handed to the after hook
+// when the statement holds it, otherwise, for Row and Rows statements whose rows
+// are returned to the application, a goroutine waits for them to be closed and
+// leaks if they never are.
+func release(ctx context.Context, conn io.Closer, rs *rowsSpan) {
+	if rs != nil {
+		rs.track(conn)
+		return
+	}
+	if c, ok := ctx.(contextWrapper); ok && c.held != nil && c.held.conn == nil {
+		c.held.conn = conn
+		return
+	}
+	go conn.Close()
+}
+
+func (p *connPool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if p.metrics == nil {
+		return p.DB.ExecContext(ctx, query, args...)
+	}
+
+	for i := 0; ; i++ {
+		conn, err := p.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := conn.ExecContext(ctx, query, args...)
+		_ = conn.Close()
+		if errors.Is(err, driver.ErrBadConn) && i < maxBadConnRetries {
+			continue
+		}
+		return result, err
+	}
+}
+
+// BeginTx implements gorm.ConnPoolBeginner, so that the transaction can be
+// observed until it is committed or rolled back.
+func (p *connPool) BeginTx(ctx context.Context, opts *sql.TxOptions) (gorm.ConnPool, error) {
+	if p.metrics == nil {
+		tx, err := p.DB.BeginTx(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		return tx, nil
+	}
+
+	for i := 0; ; i++ {
+		conn, err := p.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		tx, err := conn.BeginTx(ctx, opts)
+		if err != nil {
+			_ = conn.Close()
+			if errors.Is(err, driver.ErrBadConn) && i < maxBadConnRetries {
+				continue
+			}
+			return nil, err
+		}
+
+		return &txConn{Tx: tx, db: p.DB, conn: conn, metrics: p.metrics.StartTx(ctx)}, nil
+	}
+}
+
+// txConn wraps the *sql.Tx of a transaction to report its outcome, and returns
+// its connection to the pool once it is committed or rolled back.
+type txConn struct {
+	*sql.Tx
+
+	db      *sql.DB
+	conn    pooledConn
+	metrics *metrics.Tx
+}
+
+// GetDBConn implements gorm.GetDBConnector so that gorm.DB.DB keeps working.
+func (t *txConn) GetDBConn() (*sql.DB, error) {
+	return t.db, nil
+}
+
+func (t *txConn) Commit() error {
+	err := t.Tx.Commit()
+	_ = t.conn.Close()
+	t.metrics.End(metrics.TxCommit, err)
+	return err
+}
+
+func (t *txConn) Rollback() error {
+	err := t.Tx.Rollback()
+	_ = t.conn.Close()
+	t.metrics.End(metrics.TxRollback, err)
+	return err
+}
+
+func (p *connPool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	rs := rowsSpanFromContext(ctx)
+	if rs == nil && p.metrics == nil {
+		return p.DB.QueryContext(ctx, query, args...)
+	}
+
+	for i := 0; ; i++ {
+		conn, err := p.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if err != nil {
+			_ = conn.Close()
+			if errors.Is(err, driver.ErrBadConn) && i < maxBadConnRetries {
+				continue
+			}
+			return nil, err
+		}
+
+		release(ctx, conn, rs)
+		return rows, nil
+	}
+}
+
+func (p *connPool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	rs := rowsSpanFromContext(ctx)
+	if rs == nil && p.metrics == nil {
+		return p.DB.QueryRowContext(ctx, query, args...)
+	}
+
+	for i := 0; i <= maxBadConnRetries; i++ {
+		conn, err := p.conn(ctx)
+		if err != nil {
+			break
+		}
+
+		row := conn.QueryRowContext(ctx, query, args...)
+		if err := row.Err(); err != nil {
+			_ = conn.Close()
+			if errors.Is(err, driver.ErrBadConn) {
+				continue
+			}
+			return row
+		}
+
+		release(ctx, conn, rs)
+		return row
+	}
+
+	// *sql.Row can only be built by database/sql, so let it report the error
+	return p.DB.QueryRowContext(ctx, query, args...)
+}
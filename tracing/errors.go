@@ -0,0 +1,118 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var (
+	dbContextDeadline     = attribute.Key("db.context.deadline_remaining")
+	dbContextCancellation = attribute.Key("db.context.cancellation")
+)
+
+// deadlineAttributes describes the deadline of ctx when the statement starts.
+func deadlineAttributes(ctx context.Context) (attribute.KeyValue, bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return attribute.KeyValue{}, false
+	}
+	return dbContextDeadline.Float64(time.Until(deadline).Seconds()), true
+}
+
+// contextError returns context.Canceled or context.DeadlineExceeded if err was
+// caused by the end of ctx. Drivers do not always wrap the context error, so
+// the context itself is checked too.
+func contextError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return context.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return context.Canceled
+	}
+	return ctx.Err()
+}
+
+// fmtWrapError is the type of the errors created by fmt.Errorf with a single %w,
+// which only add context to the error they wrap.
+var fmtWrapError = reflect.TypeOf(fmt.Errorf("%w", io.EOF))
+
+// errorType returns a low cardinality error.type value for err: the status code
+// the database answered with when known, as semconv recommends, or the type of
+// the innermost error under the fmt.Errorf wrappers, usually the driver error.
+func (p *otelPlugin) errorType(ctx context.Context, err error) string {
+	switch contextError(ctx, err) {
+	case context.DeadlineExceeded:
+		return "timeout"
+	case context.Canceled:
+		return "canceled"
+	}
+	if code, ok := p.responseStatusCode(err); ok {
+		return code
+	}
+	for reflect.TypeOf(err) == fmtWrapError {
+		err = errors.Unwrap(err)
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+// sqlStateError is implemented by drivers that expose the SQLSTATE of an error,
+// such as pgx's *pgconn.PgError.
+type sqlStateError interface {
+	SQLState() string
+}
+
+// responseStatusCode returns the status code the database answered with, using
+// the WithErrorStatusCode function if set, or the SQLSTATE of the error.
+func (p *otelPlugin) responseStatusCode(err error) (string, bool) {
+	if p.statusCode != nil {
+		return p.statusCode(err)
+	}
+	var sqlState sqlStateError
+	if errors.As(err, &sqlState) && sqlState.SQLState() != "" {
+		return sqlState.SQLState(), true
+	}
+	return "", false
+}
+
+// countError increments the db.client.errors counter for the failed statement.
+func (p *otelPlugin) countError(tx *gorm.DB, c contextWrapper, info *sqlInfo) {
+	extra := []attribute.KeyValue{semconv.ErrorTypeKey.String(p.errorType(c, tx.Error))}
+	if code, ok := p.responseStatusCode(tx.Error); ok {
+		extra = append(extra, semconv.DBResponseStatusCode(code))
+	}
+	attrs := p.metricAttributes(ErrorsMetricName, tx, info, extra...)
+	p.errorCounter.Add(c.parent, 1, metric.WithAttributes(attrs...))
+}
+
+// recordError records a failed statement on span. Statements canceled by the
+// client are not marked as errors when WithoutCanceledErrors is set.
+func (p *otelPlugin) recordError(ctx context.Context, span trace.Span, err error) {
+	span.SetAttributes(semconv.ErrorTypeKey.String(p.errorType(ctx, err)))
+	if code, ok := p.responseStatusCode(err); ok {
+		span.SetAttributes(semconv.DBResponseStatusCode(code))
+	}
+
+	switch contextError(ctx, err) {
+	case context.DeadlineExceeded:
+		span.SetAttributes(dbContextCancellation.String("deadline_exceeded"))
+	case context.Canceled:
+		span.SetAttributes(dbContextCancellation.String("canceled"))
+		if p.ignoreCanceled {
+			return
+		}
+	}
+
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,210 @@
+package tracing
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxCachedPlans bounds the number of query plans kept per plugin.
+	maxCachedPlans = 256
+	// explainTimeout bounds the time an EXPLAIN may hold a connection.
+	explainTimeout = 5 * time.Second
+)
+
+var dbQueryPlan = attribute.Key("db.query.plan")
+
+// explainPrefixes are the EXPLAIN statements per dialector, dialectors without
+// an entry are never explained.
+var explainPrefixes = map[string]string{
+	"sqlite":     "EXPLAIN QUERY PLAN ",
+	"postgres":   "EXPLAIN (FORMAT JSON) ",
+	"postgresql": "EXPLAIN (FORMAT JSON) ",
+	"mysql":      "EXPLAIN FORMAT=JSON ",
+	"clickhouse": "EXPLAIN ",
+}
+
+// explainer captures the plans of slow SELECT statements. It runs at most one
+// EXPLAIN at a time and at most one per interval, and caches the plans per fingerprint.
+type explainer struct {
+	interval time.Duration
+	last     atomic.Int64
+	running  atomic.Bool
+
+	mu    sync.Mutex
+	lru   *list.List
+	plans map[string]*list.Element
+}
+
+type cachedPlan struct {
+	fingerprint string
+	plan        string
+}
+
+func newExplainer(interval time.Duration) *explainer {
+	return &explainer{
+		interval: interval,
+		lru:      list.New(),
+		plans:    make(map[string]*list.Element),
+	}
+}
+
+func (e *explainer) cached(fingerprint string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if elem, ok := e.plans[fingerprint]; ok {
+		e.lru.MoveToFront(elem)
+		return elem.Value.(*cachedPlan).plan, true
+	}
+	return "", false
+}
+
+func (e *explainer) store(fingerprint, plan string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.plans[fingerprint]; ok {
+		return
+	}
+	e.plans[fingerprint] = e.lru.PushFront(&cachedPlan{fingerprint: fingerprint, plan: plan})
+	if e.lru.Len() > maxCachedPlans {
+		oldest := e.lru.Back()
+		e.lru.Remove(oldest)
+		delete(e.plans, oldest.Value.(*cachedPlan).fingerprint)
+	}
+}
+
+// acquire reports whether an EXPLAIN may run now, release must be called once it is done.
+func (e *explainer) acquire() bool {
+	now := time.Now().UnixNano()
+	last := e.last.Load()
+	if last != 0 && now-last < int64(e.interval) {
+		return false
+	}
+	if !e.running.CompareAndSwap(false, true) {
+		return false
+	}
+	if !e.last.CompareAndSwap(last, now) {
+		e.running.Store(false)
+		return false
+	}
+	return true
+}
+
+func (e *explainer) release() {
+	e.running.Store(false)
+}
+
+// explainSlowQuery attaches the plan of a slow SELECT to its span, as a db.query.plan
+// event when the plan is cached, or on a linked span once it has been captured.
+// Only single SELECT statements without data-modifying CTEs are explained, the
+// database would run the other statements of the query again. Statements binding
+// `otel:"redact"` values are not explained either, as plans can show the bound values.
+func (p *otelPlugin) explainSlowQuery(tx *gorm.DB, span trace.Span, info *sqlInfo) {
+	if info.operation != "select" || info.statements != 1 || info.writableCTE ||
+		info.fingerprintHash == "" || redactsVars(tx) {
+		return
+	}
+	prefix, ok := explainPrefixes[tx.Dialector.Name()]
+	if !ok {
+		return
+	}
+
+	if plan, ok := p.explain.cached(info.fingerprintHash); ok {
+		span.AddEvent("db.query.plan", trace.WithAttributes(
+			dbQueryFingerprint.String(info.fingerprintHash),
+			dbQueryPlan.String(plan),
+		))
+		return
+	}
+
+	sqlDB, err := tx.DB()
+	if err != nil || sqlDB == nil || !p.explain.acquire() {
+		return
+	}
+
+	query := prefix + tx.Statement.SQL.String()
+	vars := append([]interface{}(nil), tx.Statement.Vars...)
+	attrs := []attribute.KeyValue{
+		semconv.DBQueryText(p.formatQuery(query)),
+		semconv.DBOperationName("explain"),
+		dbQueryFingerprint.String(info.fingerprintHash),
+	}
+	if sys := dbSystem(tx); sys.Valid() {
+		attrs = append(attrs, sys)
+	}
+	link := trace.Link{SpanContext: span.SpanContext()}
+
+	go func() {
+		defer p.explain.release()
+
+		ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+		defer cancel()
+		_, explainSpan := p.tracer.Start(ctx, "gorm.Explain",
+			trace.WithNewRoot(),
+			trace.WithLinks(link),
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attrs...),
+		)
+		defer explainSpan.End()
+
+		plan, err := explain(ctx, sqlDB, query, vars)
+		if err != nil {
+			explainSpan.RecordError(err)
+			explainSpan.SetStatus(codes.Error, err.Error())
+			return
+		}
+		p.explain.store(info.fingerprintHash, plan)
+		explainSpan.SetAttributes(dbQueryPlan.String(plan))
+	}()
+}
+
+// explain runs query and returns its rows as text, one line per row.
+func explain(ctx context.Context, db *sql.DB, query string, vars []interface{}) (string, error) {
+	rows, err := db.QueryContext(ctx, query, vars...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	values := make([]sql.RawBytes, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+
+	var plan strings.Builder
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return "", err
+		}
+		if plan.Len() > 0 {
+			plan.WriteByte('\n')
+		}
+		for i, v := range values {
+			if i > 0 {
+				plan.WriteByte('\t')
+			}
+			plan.Write(v)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("explain failed: %w", err)
+	}
+	return plan.String(), nil
+}
@@ -0,0 +1,408 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// redactedValue replaces the query variables of fields tagged with `otel:"redact"`.
+const redactedValue = "[REDACTED]"
+
+// AttributesProvider is implemented by models that contribute attributes to the
+// spans of the statements they take part in.
+type AttributesProvider interface {
+	OtelAttributes(ctx context.Context) []attribute.KeyValue
+}
+
+type attrField struct {
+	field *schema.Field
+	key   attribute.Key
+}
+
+// modelTags holds the fields of a schema configured with the otel struct tag, e.g.
+//
+//	TenantID string `otel:"attr=tenant.id"`
+//	Password string `otel:"redact"`
+type modelTags struct {
+	attrs    []attrField
+	redacted []*schema.Field
+}
+
+var modelTagsCache sync.Map // map[*schema.Schema]*modelTags
+
+func modelTagsOf(s *schema.Schema) *modelTags {
+	if tags, ok := modelTagsCache.Load(s); ok {
+		return tags.(*modelTags)
+	}
+
+	tags := &modelTags{}
+	for _, field := range s.Fields {
+		for _, setting := range strings.Split(field.Tag.Get("otel"), ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(setting), "=")
+			switch name {
+			case "attr":
+				if value != "" {
+					tags.attrs = append(tags.attrs, attrField{field: field, key: attribute.Key(value)})
+				}
+			case "redact":
+				tags.redacted = append(tags.redacted, field)
+			}
+		}
+	}
+
+	actual, _ := modelTagsCache.LoadOrStore(s, tags)
+	return actual.(*modelTags)
+}
+
+// modelAttributes collects the attributes contributed by the statement's model,
+// either through AttributesProvider or through `otel:"attr=<key>"` tagged fields.
+// Tagged fields are read from the model of INSERT and UPDATE statements; the model
+// of the other statements holds the fetched rows, their values are taken from the
+// equality conditions of the WHERE clause instead.
+func modelAttributes(tx *gorm.DB) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	ctx := tx.Statement.Context
+
+	if provider, ok := tx.Statement.Model.(AttributesProvider); ok {
+		attrs = append(attrs, provider.OtelAttributes(ctx)...)
+	}
+	if provider, ok := tx.Statement.Dest.(AttributesProvider); ok && !sameValue(tx.Statement.Dest, tx.Statement.Model) {
+		attrs = append(attrs, provider.OtelAttributes(ctx)...)
+	}
+
+	if tx.Statement.Schema == nil {
+		return attrs
+	}
+	writes := writesModel(tx)
+	for _, af := range modelTagsOf(tx.Statement.Schema).attrs {
+		var v interface{}
+		var ok bool
+		if writes {
+			v, ok = commonFieldValue(ctx, af.field, tx.Statement.ReflectValue)
+		} else {
+			v, ok = whereValue(tx, af.field.DBName)
+		}
+		if ok {
+			attrs = append(attrs, attributeValue(af.key, v))
+		}
+	}
+	return attrs
+}
+
+// writesModel reports whether the statement binds the values of its model,
+// as INSERT and UPDATE statements do.
+func writesModel(tx *gorm.DB) bool {
+	_, insert := tx.Statement.Clauses["INSERT"]
+	_, update := tx.Statement.Clauses["UPDATE"]
+	return insert || update
+}
+
+// whereValue returns the value column is compared to with = in the WHERE clause,
+// provided the conditions are only combined with AND.
+func whereValue(tx *gorm.DB, column string) (interface{}, bool) {
+	c, ok := tx.Statement.Clauses["WHERE"]
+	if !ok {
+		return nil, false
+	}
+	where, ok := c.Expression.(clause.Where)
+	if !ok {
+		return nil, false
+	}
+	return eqValue(where.Exprs, strings.ToLower(column))
+}
+
+func eqValue(exprs []clause.Expression, column string) (interface{}, bool) {
+	for _, expr := range exprs {
+		if _, ok := expr.(clause.OrConditions); ok {
+			return nil, false
+		}
+	}
+	for _, expr := range exprs {
+		switch e := expr.(type) {
+		case clause.Eq:
+			if e.Value != nil && columnName(e.Column) == column {
+				return e.Value, true
+			}
+		case clause.AndConditions:
+			if v, ok := eqValue(e.Exprs, column); ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func sameValue(a, b interface{}) bool {
+	t := reflect.TypeOf(a)
+	return t != nil && t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// commonFieldValue returns the value of field for a struct, or for a slice of
+// structs when all of its elements share the same non-zero value.
+func commonFieldValue(ctx context.Context, field *schema.Field, rv reflect.Value) (interface{}, bool) {
+	switch rv.Kind() {
+	case reflect.Struct:
+		v, zero := field.ValueOf(ctx, rv)
+		return v, !zero
+	case reflect.Slice, reflect.Array:
+		var common interface{}
+		for i := 0; i < rv.Len(); i++ {
+			elem := reflect.Indirect(rv.Index(i))
+			if elem.Kind() != reflect.Struct {
+				return nil, false
+			}
+			v, zero := field.ValueOf(ctx, elem)
+			if zero || (i > 0 && !reflect.DeepEqual(v, common)) {
+				return nil, false
+			}
+			common = v
+		}
+		return common, common != nil
+	default:
+		return nil, false
+	}
+}
+
+func attributeValue(key attribute.Key, v interface{}) attribute.KeyValue {
+	if s, ok := v.(fmt.Stringer); ok {
+		return key.String(s.String())
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String:
+		return key.String(rv.String())
+	case reflect.Bool:
+		return key.Bool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return key.Int64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return key.Int64(int64(rv.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return key.Float64(rv.Float())
+	default:
+		return key.String(fmt.Sprint(v))
+	}
+}
+
+// redactVars returns vars with the values of `otel:"redact"` tagged fields replaced.
+// Variables are matched by value, as the statement does not record which field
+// a variable was bound from. The secrets are taken from the WHERE and SET clauses
+// and, for INSERT and UPDATE statements, from the model and the map of Updates; the
+// model of the other statements holds the fetched rows, which are not bound. A raw
+// SQL condition that mentions a redacted column has all its variables redacted.
+func redactVars(tx *gorm.DB, vars []interface{}) []interface{} {
+	if tx.Statement.Schema == nil {
+		return vars
+	}
+	redacted := modelTagsOf(tx.Statement.Schema).redacted
+	if len(redacted) == 0 {
+		return vars
+	}
+
+	ctx := tx.Statement.Context
+	secrets := map[interface{}]struct{}{}
+	var addSecret func(v interface{})
+	addSecret = func(v interface{}) {
+		if v == nil {
+			return
+		}
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8 {
+			// IN conditions, gorm binds one variable per element
+			for i := 0; i < rv.Len(); i++ {
+				addSecret(rv.Index(i).Interface())
+			}
+			return
+		}
+		if rv.Type().Comparable() && !rv.IsZero() {
+			secrets[v] = struct{}{}
+		}
+	}
+
+	rv := tx.Statement.ReflectValue
+	if writesModel(tx) {
+		for _, field := range redacted {
+			switch rv.Kind() {
+			case reflect.Struct:
+				if v, zero := field.ValueOf(ctx, rv); !zero {
+					addSecret(v)
+				}
+			case reflect.Slice, reflect.Array:
+				for i := 0; i < rv.Len(); i++ {
+					if elem := reflect.Indirect(rv.Index(i)); elem.Kind() == reflect.Struct {
+						if v, zero := field.ValueOf(ctx, elem); !zero {
+							addSecret(v)
+						}
+					}
+				}
+			}
+
+			// Update("password", ...) and Updates(map[string]interface{}{...})
+			if m, ok := tx.Statement.Dest.(map[string]interface{}); ok {
+				if v, ok := m[field.DBName]; ok {
+					addSecret(v)
+				} else if v, ok := m[field.Name]; ok {
+					addSecret(v)
+				}
+			}
+		}
+	}
+
+	columns := make(map[string]struct{}, len(redacted))
+	for _, field := range redacted {
+		columns[strings.ToLower(field.DBName)] = struct{}{}
+	}
+	for _, name := range []string{"WHERE", "SET"} {
+		if c, ok := tx.Statement.Clauses[name]; ok {
+			clauseSecrets(c.Expression, columns, addSecret)
+		}
+	}
+	if len(secrets) == 0 {
+		return vars
+	}
+
+	result := make([]interface{}, len(vars))
+	for i, v := range vars {
+		result[i] = v
+		if v == nil || !reflect.TypeOf(v).Comparable() {
+			continue
+		}
+		if _, ok := secrets[v]; ok {
+			result[i] = redactedValue
+		}
+	}
+	return result
+}
+
+// redactsVars reports whether redactVars replaces any of the variables of tx.
+func redactsVars(tx *gorm.DB) bool {
+	for _, v := range redactVars(tx, tx.Statement.Vars) {
+		if v == redactedValue {
+			return true
+		}
+	}
+	return false
+}
+
+// clauseSecrets adds the values compared with or assigned to the redacted columns
+// in the conditions and assignments of expr.
+func clauseSecrets(expr clause.Expression, columns map[string]struct{}, add func(v interface{})) {
+	var eq clause.Eq
+	switch e := expr.(type) {
+	case clause.Where:
+		for _, expr := range e.Exprs {
+			clauseSecrets(expr, columns, add)
+		}
+		return
+	case clause.AndConditions:
+		for _, expr := range e.Exprs {
+			clauseSecrets(expr, columns, add)
+		}
+		return
+	case clause.OrConditions:
+		for _, expr := range e.Exprs {
+			clauseSecrets(expr, columns, add)
+		}
+		return
+	case clause.NotConditions:
+		for _, expr := range e.Exprs {
+			clauseSecrets(expr, columns, add)
+		}
+		return
+	case clause.Set:
+		for _, assignment := range e {
+			if isRedactedColumn(assignment.Column, columns) {
+				add(assignment.Value)
+			}
+		}
+		return
+	case clause.IN:
+		if isRedactedColumn(e.Column, columns) {
+			for _, v := range e.Values {
+				add(v)
+			}
+		}
+		return
+	case clause.Expr:
+		if mentionsColumn(e.SQL, columns) {
+			for _, v := range e.Vars {
+				add(v)
+			}
+		}
+		return
+	case clause.NamedExpr:
+		if mentionsColumn(e.SQL, columns) {
+			for _, v := range e.Vars {
+				add(v)
+			}
+		}
+		return
+	case clause.Eq:
+		eq = e
+	case clause.Neq:
+		eq = clause.Eq(e)
+	case clause.Gt:
+		eq = clause.Eq(e)
+	case clause.Gte:
+		eq = clause.Eq(e)
+	case clause.Lt:
+		eq = clause.Eq(e)
+	case clause.Lte:
+		eq = clause.Eq(e)
+	case clause.Like:
+		eq = clause.Eq(e)
+	default:
+		return
+	}
+	if isRedactedColumn(eq.Column, columns) {
+		add(eq.Value)
+	}
+}
+
+// isRedactedColumn reports whether column, a clause.Column or a possibly
+// qualified and quoted column name, is one of columns.
+func isRedactedColumn(column interface{}, columns map[string]struct{}) bool {
+	_, ok := columns[columnName(column)]
+	return ok
+}
+
+// columnName returns the lower-cased, unqualified and unquoted name of column,
+// a clause.Column or a column name, or "" for other expressions.
+func columnName(column interface{}) string {
+	var name string
+	switch c := column.(type) {
+	case clause.Column:
+		name = c.Name
+	case string:
+		name = c
+	default:
+		return ""
+	}
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(strings.Trim(name, "`\"[] "))
+}
+
+// mentionsColumn reports whether the raw SQL condition refers to one of columns.
+func mentionsColumn(sql string, columns map[string]struct{}) bool {
+	words := strings.FieldsFunc(sql, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	for _, word := range words {
+		if _, ok := columns[strings.ToLower(word)]; ok {
+			return true
+		}
+	}
+	return false
+}
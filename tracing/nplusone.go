@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"container/list"
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// maxTrackedParents bounds the number of parent spans the detector remembers,
+// as it has no way to know when a parent span ends.
+const maxTrackedParents = 4096
+
+var dbQueryCount = attribute.Key("db.query.count")
+
+type nPlusOneDetector struct {
+	threshold int
+
+	mu      sync.Mutex
+	lru     *list.List
+	parents map[trace.SpanID]*list.Element
+}
+
+type nPlusOneEntry struct {
+	parent trace.SpanID
+	counts map[string]int
+}
+
+func newNPlusOneDetector(threshold int) *nPlusOneDetector {
+	// a statement executed once is not a repetition
+	threshold = max(threshold, 1)
+	return &nPlusOneDetector{
+		threshold: threshold,
+		lru:       list.New(),
+		parents:   make(map[trace.SpanID]*list.Element),
+	}
+}
+
+// observe counts a statement with the given fingerprint under parent and
+// reports whether it has just repeated more than threshold times.
+// Each fingerprint is reported at most once per parent.
+func (d *nPlusOneDetector) observe(parent trace.SpanID, fingerprint string) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, ok := d.parents[parent]
+	if ok {
+		d.lru.MoveToFront(elem)
+	} else {
+		elem = d.lru.PushFront(&nPlusOneEntry{parent: parent, counts: make(map[string]int)})
+		d.parents[parent] = elem
+		if d.lru.Len() > maxTrackedParents {
+			oldest := d.lru.Back()
+			d.lru.Remove(oldest)
+			delete(d.parents, oldest.Value.(*nPlusOneEntry).parent)
+		}
+	}
+
+	entry := elem.Value.(*nPlusOneEntry)
+	entry.counts[fingerprint]++
+	count := entry.counts[fingerprint]
+	return count, count == d.threshold+1
+}
+
+func (p *otelPlugin) detectNPlusOne(tx *gorm.DB, parentCtx context.Context, info *sqlInfo) {
+	parent := trace.SpanFromContext(parentCtx)
+	parentID := parent.SpanContext().SpanID()
+	if !parentID.IsValid() {
+		return
+	}
+
+	fingerprint := info.fingerprint
+	if fingerprint == "" {
+		return
+	}
+
+	count, detected := p.nPlusOne.observe(parentID, fingerprint)
+	if !detected {
+		return
+	}
+
+	parent.AddEvent("db.n_plus_one", trace.WithAttributes(
+		semconv.DBQueryText(fingerprint),
+		dbQueryFingerprint.String(info.fingerprintHash),
+		dbQueryCount.Int(count),
+	))
+
+	p.nPlusOneCounter.Add(parentCtx, 1, metric.WithAttributes(p.metricAttributes(NPlusOneMetricName, tx, info)...))
+
+	if p.logNPlusOne && tx.Logger != nil {
+		tx.Logger.Warn(parentCtx, "n+1 query detected, executed %d times: %s", count, fingerprint)
+	}
+}
@@ -0,0 +1,30 @@
+package tracing
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"gorm.io/gorm"
+)
+
+// recordOperation records the duration of the statement and, for queries,
+// the number of rows it returned. The measurements are made in the context of
+// the statement span so the exemplars of sampled statements point to it.
+func (p *otelPlugin) recordOperation(tx *gorm.DB, c contextWrapper, info *sqlInfo) {
+	duration := time.Since(c.start)
+
+	var extra []attribute.KeyValue
+	failed := isError(tx.Error)
+	if failed {
+		extra = append(extra, semconv.ErrorTypeKey.String(p.errorType(c, tx.Error)))
+	}
+	attrs := p.metricAttributes(OperationDurationMetricName, tx, info, extra...)
+	p.operationDuration.Record(c.Context, duration.Seconds(), metric.WithAttributes(attrs...))
+
+	if info.operation == "select" && !failed && tx.RowsAffected >= 0 {
+		attrs := p.metricAttributes(ReturnedRowsMetricName, tx, info)
+		p.returnedRows.Record(c.Context, tx.RowsAffected, metric.WithAttributes(attrs...))
+	}
+}
@@ -1,10 +1,16 @@
 package tracing
 
 import (
+	"regexp"
+	"time"
+
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
 	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
+
+	"gorm.io/plugin/opentelemetry/metrics"
 )
 
 type Option func(p *otelPlugin)
@@ -16,6 +22,13 @@ func WithTracerProvider(provider trace.TracerProvider) Option {
 	}
 }
 
+// WithMeterProvider configures a meter provider that is used to create a meter.
+func WithMeterProvider(provider metric.MeterProvider) Option {
+	return func(p *otelPlugin) {
+		p.meterProvider = provider
+	}
+}
+
 // WithAttributes configures attributes that are used to create a span.
 func WithAttributes(attrs ...attribute.KeyValue) Option {
 	return func(p *otelPlugin) {
@@ -58,9 +71,257 @@ func WithRecordStackTrace() Option {
 	}
 }
 
-// WithServerAddressProvider sets up a factory function that returns a server address given a Dialector
+// WithServerAddressProvider sets up a factory function that returns a server address given a Dialector.
+// It is called once when the plugin is initialized, the result is reused for all the
+// statements of the *gorm.DB and the sessions derived from it.
 func WithServerAddressProvider(serverAddressProvider func(dialector gorm.Dialector) string) Option {
 	return func(p *otelPlugin) {
 		p.serverAddressProvider = serverAddressProvider
 	}
 }
+
+// WithNPlusOneDetection flags statements whose fingerprint repeats more than
+// threshold times under the same parent span. A detection adds a db.n_plus_one
+// event to the parent span and increments the db.client.n_plus_one counter.
+// Thresholds below 1 are raised to 1.
+func WithNPlusOneDetection(threshold int) Option {
+	return func(p *otelPlugin) {
+		p.nPlusOne = newNPlusOneDetector(threshold)
+	}
+}
+
+// WithNPlusOneLogging additionally reports detected N+1 queries through the gorm logger
+func WithNPlusOneLogging() Option {
+	return func(p *otelPlugin) {
+		p.logNPlusOne = true
+	}
+}
+
+// WithQueryBudgetEnforcement refuses the statements executed once the QueryBudget
+// attached with ContextWithQueryBudget is exhausted, with ErrQueryBudgetExceeded,
+// instead of only recording it. Refused statements are not sent to the database.
+func WithQueryBudgetEnforcement() Option {
+	return func(p *otelPlugin) {
+		p.enforceQueryBudget = true
+	}
+}
+
+// WithRowsIterationSpan keeps the spans of Row and Rows statements open until the
+// returned rows are closed, so that they cover the time spent iterating the result set.
+// Statements executed inside a transaction are not affected.
+//
+// A goroutine per statement waits for the rows to be closed: if the application
+// never closes them, the goroutine leaks along with the connection and the span
+// never ends. The number of rows iterated is not recorded, database/sql does not
+// expose it without wrapping the driver. Statements run as prepared statements
+// (gorm.Config.PrepareStmt) or through a custom gorm.ConnPool are not affected.
+func WithRowsIterationSpan() Option {
+	return func(p *otelPlugin) {
+		p.rowsIterationSpan = true
+	}
+}
+
+// WithCallerAttributes adds code.function.name, code.file.path and code.line.number
+// attributes pointing at the application code that issued the statement. Frames of gorm,
+// its drivers, the plugin hooks and functions matching skipPrefixes (e.g. a repository
+// package) are skipped. Call sites are resolved for sampled spans only and cached.
+func WithCallerAttributes(skipPrefixes ...string) Option {
+	return func(p *otelPlugin) {
+		p.callers = newCallerResolver(skipPrefixes)
+	}
+}
+
+// WithSchemaAttributes adds the Go model type, its primary key fields and whether soft
+// delete is in effect when the statement has a parsed schema.
+func WithSchemaAttributes() Option {
+	return func(p *otelPlugin) {
+		p.schemaAttrs = true
+	}
+}
+
+// WithColumnSelectionAttributes adds the columns selected or omitted with Select and Omit.
+// It implies WithSchemaAttributes.
+func WithColumnSelectionAttributes() Option {
+	return func(p *otelPlugin) {
+		p.schemaAttrs = true
+		p.columnAttrs = true
+	}
+}
+
+// WithClauseAttributes adds attributes derived from the statement clauses: LIMIT/OFFSET
+// values, locking strength, ON CONFLICT mode, number of joins, ORDER BY presence and
+// whether the WHERE clause is empty.
+func WithClauseAttributes() Option {
+	return func(p *otelPlugin) {
+		p.clauseAttrs = true
+	}
+}
+
+// WithSQLCacheSize configures how many parsed SQL templates are cached, 1024 by default.
+// A size of 0 disables the cache. Statements longer than 4KiB are never cached.
+func WithSQLCacheSize(size int) Option {
+	return func(p *otelPlugin) {
+		p.sqlCacheSize = size
+	}
+}
+
+// WithFingerprintMetricDimension adds the db.query.fingerprint attribute to the
+// per-statement metrics. Fingerprints are bounded by the number of distinct query
+// shapes of the application, which may still be too many for some backends.
+func WithFingerprintMetricDimension() Option {
+	return func(p *otelPlugin) {
+		p.fingerprintMetrics = true
+	}
+}
+
+// WithSlowThreshold reports statements that take longer than threshold with a
+// db.slow_query span event, carrying a snapshot of the connection pool statistics,
+// and increments the db.client.slow_queries counter.
+func WithSlowThreshold(threshold time.Duration) Option {
+	return func(p *otelPlugin) {
+		p.slowThreshold = threshold
+	}
+}
+
+// WithSlowQueryExplain captures the plan of SELECT statements slower than the
+// WithSlowThreshold threshold. The EXPLAIN runs asynchronously on a separate
+// connection, at most once per interval, and is reported on a gorm.Explain span
+// linked to the statement span. Plans are cached per fingerprint, later slow
+// executions of the same query get a db.query.plan event instead. Statements
+// binding values of `otel:"redact"` fields are never explained.
+// Supported on SQLite, PostgreSQL, MySQL and ClickHouse.
+func WithSlowQueryExplain(interval time.Duration) Option {
+	return func(p *otelPlugin) {
+		p.explain = newExplainer(interval)
+	}
+}
+
+// WithoutCanceledErrors does not mark statements canceled by the client as errors.
+// They still carry the error.type and db.context.cancellation attributes.
+// Statements that hit a context deadline are still errors.
+func WithoutCanceledErrors() Option {
+	return func(p *otelPlugin) {
+		p.ignoreCanceled = true
+	}
+}
+
+// WithProfilerLabels applies pprof labels to the goroutine while a statement runs,
+// so that CPU profiles can be sliced by db.operation.name, db.collection.name,
+// db.query.fingerprint (when the SQL is known upfront, e.g. Raw statements),
+// trace_id and span_id. The labels of the goroutine cannot be read back to be
+// restored, so they are only applied to statements whose context carries pprof
+// labels, e.g. the context passed by pprof.Do, and are reset to those afterwards.
+func WithProfilerLabels() Option {
+	return func(p *otelPlugin) {
+		p.profilerLabels = true
+	}
+}
+
+// WithDBStatsOptions configures the connection pool metrics, e.g. to report the
+// semantic convention metrics with metrics.WithSemconvMetrics.
+func WithDBStatsOptions(opts ...metrics.Option) Option {
+	return func(p *otelPlugin) {
+		p.dbStatsOpts = append(p.dbStatsOpts, opts...)
+	}
+}
+
+// WithPoolMetrics acquires the connection of every statement through m, which records
+// how long statements waited for and used their connection. Transactions release
+// their connection when they are committed or rolled back. Row and Rows statements,
+// whose rows are returned to the application, release it from a goroutine once
+// the rows are closed, a goroutine per statement that leaks along with the
+// connection if the application never closes its rows. With
+// gorm.Config.PrepareStmt only transactions are recorded, prepared statements
+// acquire their connection inside database/sql; custom gorm.ConnPool
+// implementations are not supported.
+func WithPoolMetrics(m *metrics.PoolMetrics) Option {
+	return func(p *otelPlugin) {
+		p.poolMetrics = m
+	}
+}
+
+// WithErrorMetrics counts the failed statements with the db.client.errors counter,
+// by operation, table, error.type and db.response.status_code.
+func WithErrorMetrics() Option {
+	return func(p *otelPlugin) {
+		p.errorMetrics = true
+	}
+}
+
+// WithErrorStatusCode sets the function that extracts the db.response.status_code
+// of failed statements, reported on spans and on the db.client.errors counter.
+// By default the SQLSTATE of errors implementing SQLState() string is used,
+// MySQL error numbers can be reported with:
+//
+//	WithErrorStatusCode(func(err error) (string, bool) {
+//		var mysqlErr *mysql.MySQLError
+//		if errors.As(err, &mysqlErr) {
+//			return strconv.Itoa(int(mysqlErr.Number)), true
+//		}
+//		return "", false
+//	})
+func WithErrorStatusCode(fn func(err error) (string, bool)) Option {
+	return func(p *otelPlugin) {
+		p.statusCode = fn
+	}
+}
+
+// WithMetricTableName rewrites the db.collection.name of the per-statement metrics,
+// for example to fold partitioned or sharded tables into one series. Spans keep the
+// original table name.
+func WithMetricTableName(fn func(table string) string) Option {
+	return func(p *otelPlugin) {
+		p.tableName = chainTableName(p.tableName, fn)
+	}
+}
+
+// WithMetricTableNamePattern replaces the matches of pattern in the db.collection.name
+// of the per-statement metrics with replacement, as regexp.ReplaceAllString does.
+// Rules are applied in the order they are given:
+//
+//	WithMetricTableNamePattern(regexp.MustCompile(`_\d{4}_\d{2}_\d{2}$`), "_yyyy_mm_dd")
+func WithMetricTableNamePattern(pattern *regexp.Regexp, replacement string) Option {
+	return WithMetricTableName(func(table string) string {
+		return pattern.ReplaceAllString(table, replacement)
+	})
+}
+
+func chainTableName(prev, next func(string) string) func(string) string {
+	if prev == nil {
+		return next
+	}
+	return func(table string) string {
+		return next(prev(table))
+	}
+}
+
+// WithMetricAttributeLimit caps the number of distinct db.operation.name,
+// db.collection.name and db.query.fingerprint values of the per-statement metrics,
+// the values seen once the limit is reached are reported as "_other".
+func WithMetricAttributeLimit(limit int) Option {
+	return func(p *otelPlugin) {
+		p.attrLimit = limit
+	}
+}
+
+// WithoutMetricAttributes drops the attributes with the given keys from instrument,
+// one of the instrument names such as ErrorsMetricName:
+//
+//	WithoutMetricAttributes(tracing.ErrorsMetricName, semconv.DBCollectionNameKey)
+func WithoutMetricAttributes(instrument string, keys ...attribute.Key) Option {
+	return func(p *otelPlugin) {
+		if p.dropAttrs == nil {
+			p.dropAttrs = make(map[string][]attribute.Key)
+		}
+		p.dropAttrs[instrument] = append(p.dropAttrs[instrument], keys...)
+	}
+}
+
+// WithOperationMetrics records the db.client.operation.duration and
+// db.client.response.returned_rows histograms for every statement, with the
+// bucket boundaries of metrics.DurationBoundaries and metrics.RowBoundaries.
+func WithOperationMetrics() Option {
+	return func(p *otelPlugin) {
+		p.operationMetrics = true
+	}
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"context"
+	"runtime/pprof"
+
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// spanOperations are the operations of the statements whose SQL is only built
+// after the before hooks ran.
+var spanOperations = map[string]string{
+	"gorm.Create": "insert",
+	"gorm.Query":  "select",
+	"gorm.Update": "update",
+	"gorm.Delete": "delete",
+}
+
+// withProfilerLabels adds pprof labels describing the statement to ctx. When the
+// parent context carries labels, they are applied to the current goroutine until
+// the after hook restores the parent labels.
+func (p *otelPlugin) withProfilerLabels(ctx, parent context.Context, tx *gorm.DB, spanName string, span trace.Span) context.Context {
+	labels := make([]string, 0, 10)
+	operation := spanOperations[spanName]
+	if sql := tx.Statement.SQL.String(); sql != "" {
+		// Raw and Row statements are already built
+		info := p.sqlInfo(sql)
+		operation = info.operation
+		if info.fingerprintHash != "" {
+			labels = append(labels, string(dbQueryFingerprint), info.fingerprintHash)
+		}
+	}
+	if operation != "" {
+		labels = append(labels, "db.operation.name", operation)
+	}
+	if tx.Statement.Table != "" {
+		labels = append(labels, "db.collection.name", tx.Statement.Table)
+	}
+	if sc := span.SpanContext(); sc.IsValid() {
+		labels = append(labels, "trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+	}
+
+	ctx = pprof.WithLabels(ctx, pprof.Labels(labels...))
+	if hasProfilerLabels(parent) {
+		pprof.SetGoroutineLabels(ctx)
+	}
+	return ctx
+}
+
+// hasProfilerLabels reports whether ctx carries pprof labels. The labels of the
+// goroutine cannot be read back, so they are only replaced, and restored from ctx,
+// when ctx carries the labels the goroutine runs with, e.g. inside pprof.Do.
+func hasProfilerLabels(ctx context.Context) bool {
+	found := false
+	pprof.ForLabels(ctx, func(key, value string) bool {
+		found = true
+		return false
+	})
+	return found
+}
@@ -0,0 +1,67 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var dbRowsIterationDuration = attribute.Key("db.rows.iteration_duration")
+
+type rowsSpanKey struct{}
+
+// rowsSpan keeps the span of a Row/Rows statement open until the application
+// has closed the returned rows. It cannot count the rows iterated: gorm hands the
+// *sql.Rows to the application, and ScanRows runs no callbacks.
+type rowsSpan struct {
+	span trace.Span
+	opts []trace.SpanEndOption
+
+	tracked  atomic.Bool
+	pending  atomic.Int32
+	returned time.Time
+	closed   time.Time
+}
+
+func newRowsSpan(span trace.Span, opts ...trace.SpanEndOption) *rowsSpan {
+	rs := &rowsSpan{span: span, opts: opts}
+	rs.pending.Store(2)
+	return rs
+}
+
+func rowsSpanFromContext(ctx context.Context) *rowsSpan {
+	rs, _ := ctx.Value(rowsSpanKey{}).(*rowsSpan)
+	return rs
+}
+
+// track waits in the background for conn to be released, which database/sql
+// only does once the rows read from it are closed. The goroutine leaks if the
+// rows are never closed.
+func (rs *rowsSpan) track(conn io.Closer) {
+	rs.tracked.Store(true)
+	go func() {
+		_ = conn.Close()
+		rs.closed = time.Now()
+		rs.end()
+	}()
+}
+
+// markReturned is called once the statement hooks have finished with the span.
+func (rs *rowsSpan) markReturned() {
+	rs.returned = time.Now()
+	rs.end()
+}
+
+func (rs *rowsSpan) end() {
+	if rs.pending.Add(-1) != 0 {
+		return
+	}
+	if rs.closed.After(rs.returned) {
+		rs.span.SetAttributes(dbRowsIterationDuration.Float64(rs.closed.Sub(rs.returned).Seconds()))
+	}
+	rs.span.End(rs.opts...)
+}
@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"reflect"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+var (
+	gormModelType        = attribute.Key("gorm.model.type")
+	gormModelPrimaryKeys = attribute.Key("gorm.model.primary_keys")
+	gormModelSoftDelete  = attribute.Key("gorm.model.soft_delete")
+	gormStatementSelects = attribute.Key("gorm.statement.selects")
+	gormStatementOmits   = attribute.Key("gorm.statement.omits")
+
+	deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+)
+
+type modelInfo struct {
+	attrs      []attribute.KeyValue
+	softDelete bool
+}
+
+// modelInfos caches the static attributes of a parsed model schema.
+var modelInfos sync.Map // map[*schema.Schema]*modelInfo
+
+func modelInfoOf(s *schema.Schema) *modelInfo {
+	if info, ok := modelInfos.Load(s); ok {
+		return info.(*modelInfo)
+	}
+
+	info := &modelInfo{}
+	info.attrs = append(info.attrs, gormModelType.String(s.ModelType.String()))
+	if len(s.PrimaryFields) > 0 {
+		pks := make([]string, 0, len(s.PrimaryFields))
+		for _, field := range s.PrimaryFields {
+			pks = append(pks, field.Name)
+		}
+		info.attrs = append(info.attrs, gormModelPrimaryKeys.StringSlice(pks))
+	}
+	for _, field := range s.Fields {
+		if field.FieldType == deletedAtType {
+			info.softDelete = true
+			break
+		}
+	}
+
+	actual, _ := modelInfos.LoadOrStore(s, info)
+	return actual.(*modelInfo)
+}
+
+func schemaAttributes(tx *gorm.DB, withColumns bool) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if s := tx.Statement.Schema; s != nil {
+		info := modelInfoOf(s)
+		attrs = append(attrs, info.attrs...)
+		attrs = append(attrs, gormModelSoftDelete.Bool(info.softDelete && !tx.Statement.Unscoped))
+	}
+
+	if withColumns {
+		if len(tx.Statement.Selects) > 0 {
+			attrs = append(attrs, gormStatementSelects.StringSlice(tx.Statement.Selects))
+		}
+		if len(tx.Statement.Omits) > 0 {
+			attrs = append(attrs, gormStatementOmits.StringSlice(tx.Statement.Omits))
+		}
+	}
+	return attrs
+}
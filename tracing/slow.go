@@ -0,0 +1,58 @@
+package tracing
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+var (
+	dbQueryDuration    = attribute.Key("db.query.duration")
+	dbSlowThreshold    = attribute.Key("db.query.slow_threshold")
+	dbPoolOpen         = attribute.Key("db.pool.open")
+	dbPoolMaxOpen      = attribute.Key("db.pool.max_open")
+	dbPoolInUse        = attribute.Key("db.pool.in_use")
+	dbPoolIdle         = attribute.Key("db.pool.idle")
+	dbPoolWaitCount    = attribute.Key("db.pool.wait_count")
+	dbPoolWaitDuration = attribute.Key("db.pool.wait_duration")
+)
+
+// detectSlowQuery reports the statement if it took longer than the slow threshold,
+// along with the state of the connection pool when it completed.
+func (p *otelPlugin) detectSlowQuery(tx *gorm.DB, c contextWrapper, info *sqlInfo) {
+	duration := time.Since(c.start)
+	if duration < p.slowThreshold {
+		return
+	}
+
+	p.slowQueryCounter.Add(c.parent, 1, metric.WithAttributes(p.metricAttributes(SlowQueriesMetricName, tx, info)...))
+
+	span := trace.SpanFromContext(c.Context)
+	if !span.IsRecording() {
+		return
+	}
+
+	attrs := []attribute.KeyValue{
+		dbQueryDuration.Float64(duration.Seconds()),
+		dbSlowThreshold.Float64(p.slowThreshold.Seconds()),
+	}
+	if sqlDB, err := tx.DB(); err == nil && sqlDB != nil {
+		stats := sqlDB.Stats()
+		attrs = append(attrs,
+			dbPoolOpen.Int(stats.OpenConnections),
+			dbPoolMaxOpen.Int(stats.MaxOpenConnections),
+			dbPoolInUse.Int(stats.InUse),
+			dbPoolIdle.Int(stats.Idle),
+			dbPoolWaitCount.Int64(stats.WaitCount),
+			dbPoolWaitDuration.Float64(stats.WaitDuration.Seconds()),
+		)
+	}
+	span.AddEvent("db.slow_query", trace.WithAttributes(attrs...))
+
+	if p.explain != nil {
+		p.explainSlowQuery(tx, span, info)
+	}
+}
@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	// defaultSQLCacheSize is the number of parsed SQL templates kept by default.
+	defaultSQLCacheSize = 1024
+	// maxCachedQueryLen bounds the size of the cached templates, longer statements
+	// such as batch INSERTs or long IN lists are parsed on every use instead of
+	// being kept in memory.
+	maxCachedQueryLen = 4 << 10
+)
+
+// sqlCache is an LRU cache of parsed statements keyed on their parameterized SQL.
+type sqlCache struct {
+	size int
+
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+type sqlCacheEntry struct {
+	query string
+	info  *sqlInfo
+}
+
+func newSQLCache(size int) *sqlCache {
+	return &sqlCache{
+		size:  size,
+		lru:   list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *sqlCache) get(query string) *sqlInfo {
+	if len(query) > maxCachedQueryLen {
+		info := parseSQL(query)
+		return &info
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.items[query]; ok {
+		c.lru.MoveToFront(elem)
+		c.mu.Unlock()
+		return elem.Value.(*sqlCacheEntry).info
+	}
+	c.mu.Unlock()
+
+	info := parseSQL(query)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[query]; ok {
+		return elem.Value.(*sqlCacheEntry).info
+	}
+	c.items[query] = c.lru.PushFront(&sqlCacheEntry{query: query, info: &info})
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*sqlCacheEntry).query)
+	}
+	return &info
+}
+
+// sqlInfo returns the parsed form of a parameterized SQL statement.
+func (p *otelPlugin) sqlInfo(query string) *sqlInfo {
+	if p.sqlCache == nil {
+		info := parseSQL(query)
+		return &info
+	}
+	return p.sqlCache.get(query)
+}
+
+// maxCachedSummaries bounds the number of (operation, table) summaries kept,
+// summaries beyond it are built on every use.
+const maxCachedSummaries = 1024
+
+type summaryKey struct {
+	operation string
+	table     string
+}
+
+// summaryCache holds the "<operation> <table>" summaries used when the SQL text
+// names no table, so that they are not concatenated on every statement.
+type summaryCache struct {
+	mu sync.RWMutex
+	m  map[summaryKey]string
+}
+
+func (c *summaryCache) get(operation, table string) string {
+	key := summaryKey{operation: operation, table: table}
+	c.mu.RLock()
+	summary, ok := c.m[key]
+	c.mu.RUnlock()
+	if ok {
+		return summary
+	}
+
+	summary = operation + " " + table
+	c.mu.Lock()
+	if c.m == nil {
+		c.m = make(map[summaryKey]string)
+	}
+	if len(c.m) < maxCachedSummaries {
+		c.m[key] = summary
+	}
+	c.mu.Unlock()
+	return summary
+}
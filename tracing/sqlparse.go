@@ -0,0 +1,524 @@
+package tracing
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// sqlInfo describes what a statement does, as extracted from its SQL text.
+type sqlInfo struct {
+	// operation is the lower-cased operation of the first statement,
+	// e.g. "select" for `WITH ... SELECT` or `(SELECT ...) UNION (SELECT ...)`.
+	operation string
+	// tables are the tables referenced by the statements, in order of appearance.
+	tables []string
+	// summary is a low cardinality summary such as "insert orders select users",
+	// empty if no table could be found.
+	summary string
+	// fingerprint is the query with literals replaced by ?, IN-lists collapsed,
+	// comments removed and whitespace normalized.
+	fingerprint string
+	// fingerprintHash is the hex encoded 64-bit FNV-1a hash of fingerprint.
+	fingerprintHash string
+	// statements is the number of statements separated by semicolons.
+	statements int
+	// writableCTE is set when a WITH clause holds a data-modifying statement,
+	// e.g. `WITH x AS (DELETE ... RETURNING *) SELECT ...`.
+	writableCTE bool
+}
+
+// operations are the keywords that start a (sub)statement and appear in the summary.
+var operations = []string{
+	"select", "insert", "update", "delete", "merge", "replace", "upsert",
+	"create", "alter", "drop", "truncate", "call", "explain",
+}
+
+// writeOperations are the operations that modify data inside a WITH clause.
+var writeOperations = []string{"insert", "update", "delete", "merge"}
+
+// reservedWords cannot be table names or aliases when they appear unquoted after a table reference.
+var reservedWords = []string{
+	"select", "from", "where", "join", "inner", "left", "right", "full", "outer", "cross", "natural",
+	"on", "using", "group", "order", "having", "limit", "offset", "union", "intersect", "except",
+	"set", "values", "returning", "into", "lateral", "for", "window", "fetch", "straight_join",
+	"partition", "with", "as", "default", "use", "force", "tablesample", "do", "when", "then",
+}
+
+// fromFunctions are the functions whose arguments may contain a FROM keyword.
+var fromFunctions = []string{"extract", "substring", "trim", "overlay"}
+
+func wordIn(word string, words []string) (string, bool) {
+	for _, w := range words {
+		if len(w) == len(word) && strings.EqualFold(word, w) {
+			return w, true
+		}
+	}
+	return "", false
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokQuotedIdent
+	tokString
+	tokNumber
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	// text is the token without quotes, raw includes them
+	text string
+	raw  string
+	// gap is set when whitespace or comments precede the token
+	gap bool
+}
+
+func (t token) is(word string) bool {
+	return t.kind == tokWord && len(t.text) == len(word) && strings.EqualFold(t.text, word)
+}
+
+func (t token) isPunct(c byte) bool {
+	return t.kind == tokPunct && t.text[0] == c
+}
+
+// isPlaceholder reports whether the token stands for a value in a fingerprint.
+func (t token) isPlaceholder() bool {
+	switch t.kind {
+	case tokString, tokNumber:
+		return true
+	case tokPunct:
+		return t.text[0] == '?'
+	case tokWord:
+		// postgres style $1 placeholders
+		if len(t.text) < 2 || t.text[0] != '$' {
+			return false
+		}
+		for i := 1; i < len(t.text); i++ {
+			if t.text[i] < '0' || t.text[i] > '9' {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// sqlScanner splits SQL into tokens in a single pass without allocating,
+// skipping whitespace and comments.
+type sqlScanner struct {
+	s   string
+	pos int
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func (sc *sqlScanner) next() token {
+	gap := false
+	for sc.pos < len(sc.s) {
+		c := sc.s[sc.pos]
+		start := sc.pos
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			sc.pos++
+			gap = true
+		case c == '#' || (c == '-' && sc.at(sc.pos+1) == '-'):
+			for sc.pos < len(sc.s) && sc.s[sc.pos] != '\n' {
+				sc.pos++
+			}
+			gap = true
+		case c == '/' && sc.at(sc.pos+1) == '*':
+			end := strings.Index(sc.s[sc.pos+2:], "*/")
+			if end < 0 {
+				sc.pos = len(sc.s)
+			} else {
+				sc.pos += end + 4
+			}
+			gap = true
+		case c == '\'':
+			text := sc.quoted(c)
+			return token{kind: tokString, text: text, raw: sc.s[start:sc.pos], gap: gap}
+		case c == '"' || c == '`':
+			text := sc.quoted(c)
+			return token{kind: tokQuotedIdent, text: text, raw: sc.s[start:sc.pos], gap: gap}
+		case isDigit(c):
+			for sc.pos < len(sc.s) && isWordByte(sc.s[sc.pos]) {
+				sc.pos++
+			}
+			if sc.at(sc.pos) == '.' && isDigit(sc.at(sc.pos+1)) {
+				sc.pos++
+				for sc.pos < len(sc.s) && isWordByte(sc.s[sc.pos]) {
+					sc.pos++
+				}
+			}
+			return token{kind: tokNumber, text: sc.s[start:sc.pos], raw: sc.s[start:sc.pos], gap: gap}
+		case isWordByte(c):
+			for sc.pos < len(sc.s) && isWordByte(sc.s[sc.pos]) {
+				sc.pos++
+			}
+			return token{kind: tokWord, text: sc.s[start:sc.pos], raw: sc.s[start:sc.pos], gap: gap}
+		default:
+			sc.pos++
+			return token{kind: tokPunct, text: sc.s[start:sc.pos], raw: sc.s[start:sc.pos], gap: gap}
+		}
+	}
+	return token{kind: tokEOF, gap: gap}
+}
+
+func (sc *sqlScanner) at(i int) byte {
+	if i < len(sc.s) {
+		return sc.s[i]
+	}
+	return 0
+}
+
+// quoted consumes a quoted string or identifier and returns its content.
+// A doubled quote or, in strings, a backslash escapes the next character.
+func (sc *sqlScanner) quoted(q byte) string {
+	start := sc.pos + 1
+	for i := start; i < len(sc.s); i++ {
+		switch sc.s[i] {
+		case '\\':
+			if q == '\'' {
+				i++
+			}
+		case q:
+			if sc.at(i+1) == q {
+				i++
+				continue
+			}
+			sc.pos = i + 1
+			return sc.s[start:i]
+		}
+	}
+	sc.pos = len(sc.s)
+	return sc.s[start:]
+}
+
+// inList states of the fingerprinter while it looks for IN (?, ?, ...) lists
+const (
+	inListNone = iota
+	inListOpen
+	inListValue
+	inListComma
+)
+
+// fingerprinter writes the normalized form of the tokens it is fed.
+type fingerprinter struct {
+	buf []byte
+
+	inList  int
+	inStart int
+}
+
+func (f *fingerprinter) write(tok token) {
+	if tok.kind == tokEOF {
+		return
+	}
+
+	if tok.gap && len(f.buf) > 0 {
+		f.buf = append(f.buf, ' ')
+	}
+	start := len(f.buf)
+	if tok.isPlaceholder() {
+		f.buf = append(f.buf, '?')
+	} else {
+		f.buf = append(f.buf, tok.raw...)
+	}
+
+	switch {
+	case tok.is("in"):
+		f.inList, f.inStart = inListOpen, start
+	case f.inList == inListOpen && tok.isPunct('('):
+		f.inList = inListValue
+	case f.inList == inListValue && tok.isPlaceholder():
+		f.inList = inListComma
+	case f.inList == inListComma && tok.isPunct(','):
+		f.inList = inListValue
+	case f.inList == inListComma && tok.isPunct(')'):
+		f.buf = append(f.buf[:f.inStart], "IN (?)"...)
+		f.inList = inListNone
+	default:
+		f.inList = inListNone
+	}
+}
+
+type sqlParser struct {
+	sc      sqlScanner
+	fp      fingerprinter
+	peeked  token
+	hasPeek bool
+
+	info      sqlInfo
+	summary   []byte
+	lastOp    string
+	lastTable bool
+	// opStart is where the last operation starts in summary
+	opStart int
+	// ctes are the names defined by WITH, which are not tables
+	ctes []string
+	// inStatement is set between the first token of a statement and the next semicolon
+	inStatement bool
+
+	depth     int
+	withDepth int
+	// fromParens has a bit set for each open parenthesis that belongs to a function
+	// such as EXTRACT(... FROM ...), where FROM does not introduce a table.
+	fromParens uint64
+	prevWord   string
+}
+
+// parseSQL extracts the operation, tables, summary and fingerprint of a SQL statement.
+func parseSQL(query string) sqlInfo {
+	p := sqlParser{sc: sqlScanner{s: query}, withDepth: -1}
+	p.fp.buf = make([]byte, 0, len(query))
+	p.parse()
+	if len(p.info.tables) > 0 {
+		if !p.lastTable {
+			// drop the trailing operation that only read CTEs
+			p.summary = p.summary[:p.opStart]
+		}
+		p.info.summary = string(p.summary)
+	}
+	p.info.fingerprint = string(p.fp.buf)
+	p.info.fingerprintHash = fingerprintHash(p.fp.buf)
+	return p.info
+}
+
+// fingerprintHash returns a stable, fixed length identifier of a fingerprint.
+func fingerprintHash(fingerprint []byte) string {
+	if len(fingerprint) == 0 {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(fingerprint)
+	s := strconv.FormatUint(h.Sum64(), 16)
+	return strings.Repeat("0", 16-len(s)) + s
+}
+
+func (p *sqlParser) next() token {
+	if p.hasPeek {
+		p.hasPeek = false
+		return p.peeked
+	}
+	t := p.sc.next()
+	p.fp.write(t)
+	return t
+}
+
+func (p *sqlParser) peek() token {
+	if !p.hasPeek {
+		p.peeked = p.next()
+		p.hasPeek = true
+	}
+	return p.peeked
+}
+
+func (p *sqlParser) parse() {
+	for {
+		tok := p.next()
+		if tok.kind != tokEOF && !tok.isPunct(';') && !p.inStatement {
+			p.info.statements++
+			p.inStatement = true
+		}
+		switch tok.kind {
+		case tokEOF:
+			return
+		case tokPunct:
+			p.punct(tok)
+			p.prevWord = ""
+		case tokWord:
+			p.word(tok)
+		default:
+			p.prevWord = ""
+		}
+	}
+}
+
+func (p *sqlParser) punct(tok token) {
+	switch tok.text[0] {
+	case ';':
+		if p.depth == 0 {
+			p.inStatement = false
+		}
+	case ',':
+		if p.inWith() {
+			// WITH a AS (...), b AS (...)
+			p.readCTE()
+		}
+	case '(':
+		if _, fn := wordIn(p.prevWord, fromFunctions); fn && p.depth < 64 {
+			p.fromParens |= 1 << p.depth
+		}
+		p.depth++
+	case ')':
+		if p.depth > 0 {
+			p.depth--
+			if p.depth < 64 {
+				p.fromParens &^= 1 << p.depth
+			}
+		}
+	}
+}
+
+func (p *sqlParser) inFromFunction() bool {
+	return p.depth > 0 && p.depth <= 64 && p.fromParens&(1<<(p.depth-1)) != 0
+}
+
+func (p *sqlParser) word(tok token) {
+	p.prevWord = tok.text
+	op, isOp := wordIn(tok.text, operations)
+
+	if p.info.operation == "" {
+		if _, write := wordIn(op, writeOperations); write && p.withDepth >= 0 && p.depth > p.withDepth {
+			p.info.writableCTE = true
+		}
+		switch {
+		case tok.is("with"):
+			if p.withDepth < 0 {
+				p.withDepth = p.depth
+				p.skipWords("recursive")
+				p.readCTE()
+			}
+		case isOp && (p.withDepth < 0 || p.depth == p.withDepth):
+			p.info.operation = op
+		case p.withDepth < 0 && !tok.isPlaceholder():
+			p.info.operation = strings.ToLower(tok.text)
+		}
+	}
+
+	switch {
+	case isOp:
+		p.addOperation(op)
+		if op == "update" {
+			p.readTables(false)
+		}
+	case tok.is("from"):
+		if !p.inFromFunction() {
+			p.readTables(true)
+		}
+	case tok.is("join"), tok.is("into"), tok.is("using"):
+		p.readTables(false)
+	case tok.is("table"):
+		p.skipWords("if", "not", "exists")
+		p.readTables(false)
+	}
+}
+
+// inWith reports whether the parser is between WITH and the main statement.
+func (p *sqlParser) inWith() bool {
+	return p.withDepth >= 0 && p.depth == p.withDepth && p.info.operation == ""
+}
+
+// readCTE reads the name of a common table expression.
+func (p *sqlParser) readCTE() {
+	if name, ok := p.readName(); ok {
+		p.ctes = append(p.ctes, name)
+	}
+}
+
+func (p *sqlParser) addOperation(op string) {
+	if p.lastOp == op && !p.lastTable {
+		return
+	}
+	p.opStart = len(p.summary)
+	p.appendSummary(op)
+	p.lastOp = op
+	p.lastTable = false
+}
+
+func (p *sqlParser) addTable(name string) {
+	for _, cte := range p.ctes {
+		if strings.EqualFold(cte, name) {
+			return
+		}
+	}
+	p.info.tables = append(p.info.tables, name)
+	p.appendSummary(name)
+	p.lastTable = true
+}
+
+func (p *sqlParser) appendSummary(part string) {
+	if len(p.summary) > 0 {
+		p.summary = append(p.summary, ' ')
+	}
+	p.summary = append(p.summary, part...)
+}
+
+func (p *sqlParser) skipWords(words ...string) {
+	for {
+		tok := p.peek()
+		if tok.kind != tokWord {
+			return
+		}
+		if _, ok := wordIn(tok.text, words); !ok {
+			return
+		}
+		p.next()
+	}
+}
+
+// readTables reads a table reference, or a comma separated list of them if list is set.
+func (p *sqlParser) readTables(list bool) {
+	for {
+		p.skipWords("only", "low_priority", "ignore")
+		name, ok := p.readName()
+		if !ok {
+			return
+		}
+		p.addTable(name)
+		if !list {
+			return
+		}
+
+		// optional alias
+		if tok := p.peek(); tok.is("as") {
+			p.next()
+			p.next()
+		} else if tok.kind == tokQuotedIdent || (tok.kind == tokWord && !isReserved(tok.text)) {
+			p.next()
+		}
+
+		if !p.peek().isPunct(',') {
+			return
+		}
+		p.next()
+	}
+}
+
+func isReserved(word string) bool {
+	_, ok := wordIn(word, reservedWords)
+	return ok
+}
+
+// readName reads a possibly qualified and quoted name such as `db`.`users`.
+func (p *sqlParser) readName() (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokQuotedIdent && (tok.kind != tokWord || isReserved(tok.text)) {
+		return "", false
+	}
+	p.next()
+	p.prevWord = ""
+
+	name := tok.text
+	for p.peek().isPunct('.') {
+		p.next()
+		part := p.peek()
+		if part.kind != tokWord && part.kind != tokQuotedIdent {
+			break
+		}
+		p.next()
+		name += "." + part.text
+	}
+	return name, true
+}
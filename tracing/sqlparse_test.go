@@ -0,0 +1,244 @@
+package tracing
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSQL(t *testing.T) {
+	tests := []struct {
+		query     string
+		operation string
+		tables    []string
+		summary   string
+	}{
+		{
+			query:     "SELECT 42",
+			operation: "select",
+		},
+		{
+			query:     "/* app:api */ -- comment\n  ;select * from users",
+			operation: "select",
+			tables:    []string{"users"},
+			summary:   "select users",
+		},
+		{
+			query:     "SELECT id FROM `foo` WHERE id = ?",
+			operation: "select",
+			tables:    []string{"foo"},
+			summary:   "select foo",
+		},
+		{
+			query:     `SELECT o.id FROM "public"."orders" AS o JOIN users u ON u.id = o.user_id WHERE o.note = 'from x'`,
+			operation: "select",
+			tables:    []string{"public.orders", "users"},
+			summary:   "select public.orders users",
+		},
+		{
+			query:     "SELECT * FROM a, b c WHERE EXTRACT(YEAR FROM c.created_at) = 2024",
+			operation: "select",
+			tables:    []string{"a", "b"},
+			summary:   "select a b",
+		},
+		{
+			query:     "WITH recent AS (SELECT * FROM orders WHERE id > 10) UPDATE users SET flag = 1 FROM recent",
+			operation: "update",
+			tables:    []string{"orders", "users"},
+			summary:   "select orders update users",
+		},
+		{
+			query:     "WITH ids AS (SELECT id FROM raw_items) SELECT id FROM ids",
+			operation: "select",
+			tables:    []string{"raw_items"},
+			summary:   "select raw_items",
+		},
+		{
+			query:     "WITH RECURSIVE a(n) AS (SELECT 1 UNION ALL SELECT n + 1 FROM a), b AS (SELECT * FROM items) SELECT * FROM a JOIN b ON TRUE JOIN users ON TRUE",
+			operation: "select",
+			tables:    []string{"items", "users"},
+			summary:   "select items select users",
+		},
+		{
+			query:     "(SELECT id FROM a) UNION (SELECT id FROM b)",
+			operation: "select",
+			tables:    []string{"a", "b"},
+			summary:   "select a select b",
+		},
+		{
+			query:     "INSERT INTO shipping_details (id) SELECT id FROM orders",
+			operation: "insert",
+			tables:    []string{"shipping_details", "orders"},
+			summary:   "insert shipping_details select orders",
+		},
+		{
+			query:     "EXPLAIN QUERY PLAN SELECT * FROM users WHERE id IN (SELECT user_id FROM orders)",
+			operation: "explain",
+			tables:    []string{"users", "orders"},
+			summary:   "explain select users select orders",
+		},
+		{
+			query:     "DELETE FROM sessions WHERE expired; VACUUM",
+			operation: "delete",
+			tables:    []string{"sessions"},
+			summary:   "delete sessions",
+		},
+		{
+			query:     "CREATE TABLE IF NOT EXISTS foo (id int)",
+			operation: "create",
+			tables:    []string{"foo"},
+			summary:   "create foo",
+		},
+		{
+			query:     "PRAGMA foreign_keys = ON",
+			operation: "pragma",
+		},
+	}
+
+	for _, test := range tests {
+		info := parseSQL(test.query)
+		require.Equal(t, test.operation, info.operation, test.query)
+		require.Equal(t, test.tables, info.tables, test.query)
+		require.Equal(t, test.summary, info.summary, test.query)
+	}
+}
+
+func TestParseSQLStatements(t *testing.T) {
+	tests := []struct {
+		query       string
+		statements  int
+		writableCTE bool
+	}{
+		{query: "SELECT 1", statements: 1},
+		{query: "SELECT 1;", statements: 1},
+		{query: "  ; SELECT 1 ;; ", statements: 1},
+		{query: "SELECT id FROM t; INSERT INTO log VALUES (1)", statements: 2},
+		{query: "SELECT ';' FROM t -- ;\n", statements: 1},
+		{query: "CREATE TRIGGER tr AFTER INSERT ON t BEGIN SELECT 1; END", statements: 2},
+		{query: "WITH x AS (SELECT id FROM t) SELECT * FROM x", statements: 1},
+		{query: "WITH x AS (DELETE FROM t RETURNING *) SELECT * FROM x", statements: 1, writableCTE: true},
+		{query: "WITH a AS (SELECT 1), b AS (UPDATE t SET n = 1 RETURNING n) SELECT * FROM b", statements: 1, writableCTE: true},
+		{query: "WITH x AS (SELECT id FROM t) UPDATE u SET n = 1 FROM x", statements: 1},
+		{query: "SELECT * FROM (SELECT id FROM t) x FOR UPDATE", statements: 1},
+	}
+	for _, test := range tests {
+		info := parseSQL(test.query)
+		require.Equal(t, test.statements, info.statements, test.query)
+		require.Equal(t, test.writableCTE, info.writableCTE, test.query)
+	}
+}
+
+func TestSQLFingerprint(t *testing.T) {
+	tests := map[string]string{
+		"SELECT * FROM users WHERE id = 42":                   "SELECT * FROM users WHERE id = ?",
+		"SELECT * FROM users WHERE name = 'it''s' /* c */":    "SELECT * FROM users WHERE name = ?",
+		"SELECT * FROM users\n\tWHERE id IN (1, 2, 3)":        "SELECT * FROM users WHERE id IN (?)",
+		"SELECT * FROM events_2024 WHERE id in (?,?) -- tail": "SELECT * FROM events_2024 WHERE id IN (?)",
+		"SELECT * FROM t WHERE a = $1 AND b IN ($2, $3)":      "SELECT * FROM t WHERE a = ? AND b IN (?)",
+		"SELECT * FROM t WHERE id IN (SELECT id FROM u)":      "SELECT * FROM t WHERE id IN (SELECT id FROM u)",
+		"SELECT price * 1.5 FROM t1":                          "SELECT price * ? FROM t1",
+	}
+	for query, want := range tests {
+		require.Equal(t, want, parseSQL(query).fingerprint, query)
+	}
+}
+
+func TestSQLFingerprintHash(t *testing.T) {
+	a := parseSQL("SELECT * FROM users WHERE id IN (1, 2) AND name = 'a'")
+	b := parseSQL("SELECT *  FROM users /* x */ WHERE id IN (?) AND name = ?")
+	require.Len(t, a.fingerprintHash, 16)
+	require.Equal(t, a.fingerprintHash, b.fingerprintHash)
+	require.NotEqual(t, a.fingerprintHash, parseSQL("SELECT * FROM orders WHERE id = ?").fingerprintHash)
+	// the hash must not change across releases
+	require.Equal(t, "199e7dca63ea8858", parseSQL("SELECT 1").fingerprintHash)
+	require.Empty(t, parseSQL("").fingerprintHash)
+}
+
+func TestSQLCache(t *testing.T) {
+	c := newSQLCache(2)
+	a := c.get("SELECT * FROM a")
+	require.Same(t, a, c.get("SELECT * FROM a"))
+	c.get("SELECT * FROM b")
+	c.get("SELECT * FROM c")
+	require.Equal(t, 2, c.lru.Len())
+	require.NotSame(t, a, c.get("SELECT * FROM a"))
+
+	// long statements are not kept in memory
+	long := "INSERT INTO a VALUES (?)" + strings.Repeat(",(?)", maxCachedQueryLen)
+	require.Equal(t, "insert", c.get(long).operation)
+	_, ok := c.items[long]
+	require.False(t, ok)
+}
+
+var benchmarkQueries = []string{
+	"SELECT * FROM `users` WHERE `users`.`id` = ? AND `users`.`deleted_at` IS NULL ORDER BY `users`.`id` LIMIT 1",
+	"INSERT INTO `orders` (`user_id`,`amount`,`created_at`) VALUES (?,?,?) RETURNING `id`",
+	"/* request_id=42 */ WITH recent AS (SELECT id FROM orders WHERE created_at > ?) SELECT u.name FROM users u JOIN recent r ON r.id = u.id WHERE u.id IN (?,?,?,?)",
+}
+
+// legacy implementation, kept to compare against the regex pipeline the lexer replaced
+var (
+	legacyFirstWordRegex     = regexp.MustCompile(`^\w+`)
+	legacyCCommentRegex      = regexp.MustCompile(`(?is)/\*.*?\*/`)
+	legacyLineCommentRegex   = regexp.MustCompile(`(?im)(?:--|#).*?$`)
+	legacySQLPrefixRegex     = regexp.MustCompile(`^[\s;]*`)
+	legacyStringLiteralRegex = regexp.MustCompile(`'(?:[^']|'')*'`)
+	legacyNumberLiteralRegex = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	legacyInListRegex        = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	legacyWhitespaceRegex    = regexp.MustCompile(`\s+`)
+)
+
+func legacyDBOperation(query string) string {
+	s := legacyCCommentRegex.ReplaceAllString(query, "")
+	s = legacyLineCommentRegex.ReplaceAllString(s, "")
+	s = legacySQLPrefixRegex.ReplaceAllString(s, "")
+	return strings.ToLower(legacyFirstWordRegex.FindString(s))
+}
+
+func legacySQLFingerprint(query string) string {
+	s := legacyCCommentRegex.ReplaceAllString(query, "")
+	s = legacyLineCommentRegex.ReplaceAllString(s, "")
+	s = legacyStringLiteralRegex.ReplaceAllString(s, "?")
+	s = legacyNumberLiteralRegex.ReplaceAllString(s, "?")
+	s = legacyInListRegex.ReplaceAllString(s, "IN (?)")
+	s = legacyWhitespaceRegex.ReplaceAllString(s, " ")
+	return strings.TrimSpace(s)
+}
+
+func BenchmarkSQLAnalysis(b *testing.B) {
+	b.Run("regex", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			query := benchmarkQueries[i%len(benchmarkQueries)]
+			_ = legacyDBOperation(query)
+			_ = legacySQLFingerprint(query)
+		}
+	})
+
+	b.Run("lexer", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = parseSQL(benchmarkQueries[i%len(benchmarkQueries)])
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		c := newSQLCache(defaultSQLCacheSize)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = c.get(benchmarkQueries[i%len(benchmarkQueries)])
+		}
+	})
+}
+
+func TestSQLCacheAllocations(t *testing.T) {
+	c := newSQLCache(defaultSQLCacheSize)
+	query := benchmarkQueries[0]
+	c.get(query)
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = c.get(query)
+	})
+	require.Zero(t, allocs)
+}
@@ -0,0 +1,29 @@
+package tracing
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// startOptions returns the span start options shared by every statement of db:
+// the span kind and the attributes that only depend on the plugin and the dialector.
+// Initialize computes them once and hands them to the before hooks.
+func (p *otelPlugin) startOptions(db *gorm.DB) []trace.SpanStartOption {
+	attrs := make([]attribute.KeyValue, 0, len(p.attrs)+2)
+	attrs = append(attrs, p.attrs...)
+	if db.Dialector != nil {
+		if sys := dbSystem(db); sys.Valid() {
+			attrs = append(attrs, sys)
+		}
+		if p.serverAddressProvider != nil {
+			attrs = append(attrs, semconv.ServerAddressKey.String(p.serverAddressProvider(db.Dialector)))
+		}
+	}
+
+	return []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	}
+}
@@ -4,14 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"database/sql/driver"
+	"errors"
 	"fmt"
 	"io"
-	"regexp"
-	"strings"
+	"runtime/pprof"
+	"sync"
+	"time"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
 	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
 	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
@@ -20,78 +22,211 @@ import (
 )
 
 var (
-	firstWordRegex   = regexp.MustCompile(`^\w+`)
-	cCommentRegex    = regexp.MustCompile(`(?is)/\*.*?\*/`)
-	lineCommentRegex = regexp.MustCompile(`(?im)(?:--|#).*?$`)
-	sqlPrefixRegex   = regexp.MustCompile(`^[\s;]*`)
-
-	dbRowsAffected = attribute.Key("db.rows_affected")
+	dbRowsAffected     = attribute.Key("db.rows_affected")
+	dbQueryFingerprint = attribute.Key("db.query.fingerprint")
 )
 
+const instrumName = "gorm.io/plugin/opentelemetry"
+
 type otelPlugin struct {
 	provider               trace.TracerProvider
 	tracer                 trace.Tracer
+	meterProvider          metric.MeterProvider
+	meter                  metric.Meter
 	attrs                  []attribute.KeyValue
 	excludeQueryVars       bool
 	excludeMetrics         bool
+	dbStatsOpts            []metrics.Option
+	poolMetrics            *metrics.PoolMetrics
 	serverAddressProvider  func(dialector gorm.Dialector) string
 	recordStackTraceInSpan bool
 	queryFormatter         func(query string) string
+
+	nPlusOne        *nPlusOneDetector
+	logNPlusOne     bool
+	nPlusOneCounter metric.Int64Counter
+
+	enforceQueryBudget bool
+	rowsIterationSpan  bool
+	callers            *callerResolver
+	schemaAttrs        bool
+	columnAttrs        bool
+	clauseAttrs        bool
+	sqlCacheSize       int
+	sqlCache           *sqlCache
+	summaries          summaryCache
+	fingerprintMetrics bool
+	slowThreshold      time.Duration
+	slowQueryCounter   metric.Int64Counter
+	explain            *explainer
+	ignoreCanceled     bool
+	profilerLabels     bool
+	errorMetrics       bool
+	errorCounter       metric.Int64Counter
+	statusCode         func(err error) (string, bool)
+	tableName          func(table string) string
+	attrLimit          int
+	attrLimiter        *attributeLimiter
+	dropAttrs          map[string][]attribute.Key
+	operationMetrics   bool
+	operationDuration  metric.Float64Histogram
+	returnedRows       metric.Int64Histogram
+
+	mu            sync.Mutex
+	registrations []metric.Registration
 }
 
 func NewPlugin(opts ...Option) gorm.Plugin {
-	p := &otelPlugin{}
+	p := &otelPlugin{sqlCacheSize: defaultSQLCacheSize}
 	for _, opt := range opts {
 		opt(p)
 	}
 
+	if p.sqlCacheSize > 0 {
+		p.sqlCache = newSQLCache(p.sqlCacheSize)
+	}
+	if p.attrLimit > 0 {
+		p.attrLimiter = newAttributeLimiter(p.attrLimit)
+	}
+
 	if p.provider == nil {
 		p.provider = otel.GetTracerProvider()
 	}
-	p.tracer = p.provider.Tracer("gorm.io/plugin/opentelemetry")
+	p.tracer = p.provider.Tracer(instrumName)
+
+	if p.meterProvider == nil {
+		p.meterProvider = otel.GetMeterProvider()
+	}
+	p.meter = p.meterProvider.Meter(instrumName)
 
 	return p
 }
 
-func (p otelPlugin) Name() string {
+func (p *otelPlugin) Name() string {
 	return "otelgorm"
 }
 
+// Close unregisters the metric callbacks of all the databases the plugin was used with.
+// It must be called once they are closed, as the plugin cannot observe sql.DB.Close.
+// The plugin returned by NewPlugin implements io.Closer.
+func (p *otelPlugin) Close() error {
+	p.mu.Lock()
+	registrations := p.registrations
+	p.registrations = nil
+	p.mu.Unlock()
+
+	var errs []error
+	for _, reg := range registrations {
+		if err := reg.Unregister(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *otelPlugin) addRegistration(reg metric.Registration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.registrations = append(p.registrations, reg)
+}
+
 type gormHookFunc func(tx *gorm.DB)
 
 type gormRegister interface {
 	Register(name string, fn func(*gorm.DB)) error
 }
 
-func (p otelPlugin) Initialize(db *gorm.DB) (err error) {
+func (p *otelPlugin) Initialize(db *gorm.DB) (err error) {
 	if !p.excludeMetrics {
 		if sqlDB, err := db.DB(); err == nil {
-			metrics.ReportDBStatsMetrics(sqlDB)
+			opts := append([]metrics.Option{metrics.WithMeterProvider(p.meterProvider)}, p.dbStatsOpts...)
+			reg, err := metrics.ReportDBStatsMetrics(sqlDB, opts...)
+			if err != nil {
+				return err
+			}
+			p.addRegistration(reg)
 		}
 	}
 
+	if p.nPlusOne != nil {
+		p.nPlusOneCounter, err = p.meter.Int64Counter(
+			NPlusOneMetricName,
+			metric.WithDescription("The number of detected N+1 query patterns"),
+		)
+		if err != nil {
+			return fmt.Errorf("create n+1 counter failed: %w", err)
+		}
+	}
+
+	if p.slowThreshold > 0 {
+		p.slowQueryCounter, err = p.meter.Int64Counter(
+			SlowQueriesMetricName,
+			metric.WithDescription("The number of statements slower than the configured threshold"),
+		)
+		if err != nil {
+			return fmt.Errorf("create slow query counter failed: %w", err)
+		}
+	}
+
+	if p.errorMetrics {
+		p.errorCounter, err = p.meter.Int64Counter(
+			ErrorsMetricName,
+			metric.WithDescription("The number of failed statements by error.type and db.response.status_code"),
+			metric.WithUnit("{error}"),
+		)
+		if err != nil {
+			return fmt.Errorf("create error counter failed: %w", err)
+		}
+	}
+
+	if p.operationMetrics {
+		p.operationDuration, err = p.meter.Float64Histogram(
+			OperationDurationMetricName,
+			metric.WithDescription(semconv.DBClientOperationDurationDescription),
+			metric.WithUnit(semconv.DBClientOperationDurationUnit),
+			metric.WithExplicitBucketBoundaries(metrics.DurationBoundaries...),
+		)
+		if err != nil {
+			return fmt.Errorf("create operation duration histogram failed: %w", err)
+		}
+		p.returnedRows, err = p.meter.Int64Histogram(
+			ReturnedRowsMetricName,
+			metric.WithDescription(semconv.DBClientResponseReturnedRowsDescription),
+			metric.WithUnit(semconv.DBClientResponseReturnedRowsUnit),
+			metric.WithExplicitBucketBoundaries(metrics.RowBoundaries...),
+		)
+		if err != nil {
+			return fmt.Errorf("create returned rows histogram failed: %w", err)
+		}
+	}
+
+	if p.rowsIterationSpan || p.poolMetrics != nil {
+		p.wrapConnPool(db)
+	}
+
+	opts := p.startOptions(db)
 	cb := db.Callback()
 	hooks := []struct {
 		callback gormRegister
 		hook     gormHookFunc
 		name     string
 	}{
-		{cb.Create().Before("gorm:create"), p.before("gorm.Create"), "before:create"},
+		{cb.Create().Before("gorm:create"), p.before("gorm.Create", opts...), "before:create"},
 		{cb.Create().After("gorm:create"), p.after(), "after:create"},
 
-		{cb.Query().Before("gorm:query"), p.before("gorm.Query"), "before:select"},
+		{cb.Query().Before("gorm:query"), p.before("gorm.Query", opts...), "before:select"},
 		{cb.Query().After("gorm:query"), p.after(), "after:select"},
 
-		{cb.Delete().Before("gorm:delete"), p.before("gorm.Delete"), "before:delete"},
+		{cb.Delete().Before("gorm:delete"), p.before("gorm.Delete", opts...), "before:delete"},
 		{cb.Delete().After("gorm:delete"), p.after(), "after:delete"},
 
-		{cb.Update().Before("gorm:update"), p.before("gorm.Update"), "before:update"},
+		{cb.Update().Before("gorm:update"), p.before("gorm.Update", opts...), "before:update"},
 		{cb.Update().After("gorm:update"), p.after(), "after:update"},
 
-		{cb.Row().Before("gorm:row"), p.before("gorm.Row"), "before:row"},
+		{cb.Row().Before("gorm:row"), p.before("gorm.Row", opts...), "before:row"},
 		{cb.Row().After("gorm:row"), p.after(), "after:row"},
 
-		{cb.Raw().Before("gorm:raw"), p.before("gorm.Raw"), "before:raw"},
+		{cb.Raw().Before("gorm:raw"), p.before("gorm.Raw", opts...), "before:raw"},
 		{cb.Raw().After("gorm:raw"), p.after(), "after:raw"},
 	}
 
@@ -109,59 +244,126 @@ func (p otelPlugin) Initialize(db *gorm.DB) (err error) {
 type contextWrapper struct {
 	context.Context
 	parent context.Context
+	start  time.Time
+	// held is the connection acquired by the statement, with WithPoolMetrics
+	held *heldConn
 }
 
-func (p *otelPlugin) before(spanName string) gormHookFunc {
+func (p *otelPlugin) before(spanName string, opts ...trace.SpanStartOption) gormHookFunc {
 	return func(tx *gorm.DB) {
 		parentCtx := tx.Statement.Context
-		ctx, span := p.tracer.Start(tx.Statement.Context, spanName, trace.WithSpanKind(trace.SpanKindClient))
-		tx.Statement.Context = contextWrapper{ctx, parentCtx}
-		if p.serverAddressProvider != nil {
-			serverAddrAttr := semconv.ServerAddressKey.String(p.serverAddressProvider(tx.Config.Dialector))
-			span.SetAttributes(serverAddrAttr)
+		ctx, span := p.tracer.Start(tx.Statement.Context, spanName, opts...)
+		if p.rowsIterationSpan && spanName == "gorm.Row" && span.IsRecording() {
+			rs := newRowsSpan(span, trace.WithStackTrace(p.recordStackTraceInSpan))
+			ctx = context.WithValue(ctx, rowsSpanKey{}, rs)
+		}
+		if p.profilerLabels {
+			ctx = p.withProfilerLabels(ctx, parentCtx, tx, spanName, span)
+		}
+		if b := queryBudgetFromContext(parentCtx); b != nil {
+			p.startQueryBudget(tx, b)
+		}
+		var held *heldConn
+		if p.poolMetrics != nil && spanName != "gorm.Row" {
+			held = &heldConn{}
+		}
+		tx.Statement.Context = contextWrapper{ctx, parentCtx, time.Now(), held}
+		if span.IsRecording() {
+			if attr, ok := deadlineAttributes(parentCtx); ok {
+				span.SetAttributes(attr)
+			}
 		}
 	}
 }
 
 func (p *otelPlugin) after() gormHookFunc {
 	return func(tx *gorm.DB) {
-		defer func() {
-			if c, ok := tx.Statement.Context.(contextWrapper); ok {
-				// recover previous context
-				tx.Statement.Context = c.parent
+		c, ok := tx.Statement.Context.(contextWrapper)
+		span := trace.SpanFromContext(tx.Statement.Context)
+
+		// the SQL is parsed at most once per statement, the cache is shared by all goroutines
+		stmt := tx.Statement.SQL.String()
+		var info *sqlInfo
+		if span.IsRecording() || (ok && (p.nPlusOne != nil || p.slowThreshold > 0 || p.errorMetrics || p.operationMetrics)) {
+			info = p.sqlInfo(stmt)
+		}
+
+		if ok {
+			if c.held != nil {
+				// the rows of the statement are closed by now
+				c.held.release()
+			}
+			// recover previous context
+			defer func() { tx.Statement.Context = c.parent }()
+			if p.profilerLabels && hasProfilerLabels(c.parent) {
+				defer pprof.SetGoroutineLabels(c.parent)
 			}
-		}()
 
-		span := trace.SpanFromContext(tx.Statement.Context)
+			if p.nPlusOne != nil {
+				p.detectNPlusOne(tx, c.parent, info)
+			}
+			if b := queryBudgetFromContext(c.parent); b != nil {
+				p.accountQueryBudget(tx, b, c)
+			}
+			if p.slowThreshold > 0 {
+				p.detectSlowQuery(tx, c, info)
+			}
+			if p.errorMetrics && isError(tx.Error) {
+				p.countError(tx, c, info)
+			}
+			if p.operationMetrics {
+				p.recordOperation(tx, c, info)
+			}
+		}
+
 		if !span.IsRecording() {
 			return
 		}
-		defer span.End(trace.WithStackTrace(p.recordStackTraceInSpan))
+		if rs := rowsSpanFromContext(tx.Statement.Context); rs != nil && rs.tracked.Load() {
+			// the span ends once the application closes the rows
+			defer rs.markReturned()
+		} else {
+			defer span.End(trace.WithStackTrace(p.recordStackTraceInSpan))
+		}
 
-		attrs := make([]attribute.KeyValue, 0, len(p.attrs)+4)
-		attrs = append(attrs, p.attrs...)
+		attrs := make([]attribute.KeyValue, 0, 16)
 
-		if sys := dbSystem(tx); sys.Valid() {
-			attrs = append(attrs, sys)
+		if p.callers != nil {
+			attrs = append(attrs, p.callers.attributes()...)
 		}
 
-		vars := tx.Statement.Vars
+		if p.schemaAttrs || p.columnAttrs {
+			attrs = append(attrs, schemaAttributes(tx, p.columnAttrs)...)
+		}
 
-		var query string
-		if p.excludeQueryVars {
-			query = tx.Statement.SQL.String()
-		} else {
-			query = tx.Dialector.Explain(tx.Statement.SQL.String(), vars...)
+		if p.clauseAttrs {
+			attrs = append(attrs, clauseAttributes(tx)...)
 		}
 
-		formatQuery := p.formatQuery(query)
-		attrs = append(attrs, semconv.DBQueryText(formatQuery))
-		operation := dbOperation(formatQuery)
-		attrs = append(attrs, semconv.DBOperationName(operation))
-		if tx.Statement.Table != "" {
-			attrs = append(attrs, semconv.DBCollectionName(tx.Statement.Table))
+		attrs = append(attrs, modelAttributes(tx)...)
+
+		query := stmt
+		if !p.excludeQueryVars {
+			query = tx.Dialector.Explain(stmt, redactVars(tx, tx.Statement.Vars)...)
+		}
+
+		attrs = append(attrs, semconv.DBQueryText(p.formatQuery(query)))
+		attrs = append(attrs, semconv.DBOperationName(info.operation))
+		if info.fingerprintHash != "" {
+			attrs = append(attrs, dbQueryFingerprint.String(info.fingerprintHash))
+		}
+
+		table := collectionName(tx, info)
+		if table != "" {
+			attrs = append(attrs, semconv.DBCollectionName(table))
+		}
+
+		dbQuerySummary := info.summary
+		if dbQuerySummary == "" && table != "" {
+			dbQuerySummary = p.summaries.get(info.operation, table)
+		}
+		if dbQuerySummary != "" {
 			// add attr `db.query.summary`
-			dbQuerySummary := operation + " " + tx.Statement.Table
 			attrs = append(attrs, semconv.DBQuerySummary(dbQuerySummary))
 
 			// according to semconv, we should update the span name here if `db.query.summary`is available
@@ -174,20 +376,53 @@ func (p *otelPlugin) after() gormHookFunc {
 		}
 
 		span.SetAttributes(attrs...)
-		switch tx.Error {
-		case nil,
-			gorm.ErrRecordNotFound,
-			driver.ErrSkip,
-			io.EOF, // end of rows iterator
-			sql.ErrNoRows:
-			// ignore
-		default:
-			span.RecordError(tx.Error)
-			span.SetStatus(codes.Error, tx.Error.Error())
+
+		if isError(tx.Error) {
+			p.recordError(tx.Statement.Context, span, tx.Error)
 		}
 	}
 }
 
+// isError reports whether err is a failure of the statement rather than an expected outcome.
+func isError(err error) bool {
+	switch err {
+	case nil,
+		gorm.ErrRecordNotFound,
+		driver.ErrSkip,
+		io.EOF, // end of rows iterator
+		sql.ErrNoRows:
+		return false
+	}
+	return true
+}
+
+// metricAttributes are the dimensions of the per-statement metrics, along with
+// the extra ones of instrument, normalized for instrument.
+func (p *otelPlugin) metricAttributes(instrument string, tx *gorm.DB, info *sqlInfo, extra ...attribute.KeyValue) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, 4+len(extra))
+	if sys := dbSystem(tx); sys.Valid() {
+		attrs = append(attrs, sys)
+	}
+	attrs = append(attrs, semconv.DBOperationName(info.operation))
+	if table := collectionName(tx, info); table != "" {
+		attrs = append(attrs, semconv.DBCollectionName(table))
+	}
+	if p.fingerprintMetrics && info.fingerprintHash != "" {
+		attrs = append(attrs, dbQueryFingerprint.String(info.fingerprintHash))
+	}
+	attrs = append(attrs, extra...)
+	return p.normalizeAttributes(instrument, attrs)
+}
+
+// collectionName is the table of the statement, or the only table its SQL
+// refers to, e.g. for Raw and Exec statements.
+func collectionName(tx *gorm.DB, info *sqlInfo) string {
+	if tx.Statement.Table == "" && len(info.tables) == 1 {
+		return info.tables[0]
+	}
+	return tx.Statement.Table
+}
+
 func (p *otelPlugin) formatQuery(query string) string {
 	if p.queryFormatter != nil {
 		return p.queryFormatter(query)
@@ -215,10 +450,3 @@ func dbSystem(tx *gorm.DB) attribute.KeyValue {
 		return attribute.KeyValue{}
 	}
 }
-
-func dbOperation(query string) string {
-	s := cCommentRegex.ReplaceAllString(query, "")
-	s = lineCommentRegex.ReplaceAllString(s, "")
-	s = sqlPrefixRegex.ReplaceAllString(s, "")
-	return strings.ToLower(firstWordRegex.FindString(s))
-}
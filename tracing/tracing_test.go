@@ -1,13 +1,24 @@
 package tracing
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/exemplar"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	semconv "go.opentelemetry.io/otel/semconv/v1.30.0"
@@ -16,6 +27,9 @@ import (
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"gorm.io/plugin/opentelemetry/metrics"
 )
 
 type Test struct {
@@ -166,6 +180,24 @@ func TestOtel(t *testing.T) {
 				require.Equal(t, "test.dsn", m[semconv.ServerAddressKey].AsString())
 			},
 		},
+		{
+			do: func(ctx context.Context, db *gorm.DB) {
+				err := db.Exec("CREATE TABLE IF NOT EXISTS raw_items (id int)").Error
+				require.NoError(t, err)
+				var ids []int
+				err = db.WithContext(ctx).Raw("WITH ids AS (SELECT id FROM raw_items) SELECT id FROM ids").Scan(&ids).Error
+				require.NoError(t, err)
+			},
+			require: func(t *testing.T, spans []sdktrace.ReadOnlySpan) {
+				require.Equal(t, 2, len(spans))
+				require.Equal(t, "create raw_items", spans[0].Name())
+				require.Equal(t, "select raw_items", spans[1].Name())
+
+				m := attrMap(spans[1].Attributes())
+				require.Equal(t, "select", m[semconv.DBOperationNameKey].AsString())
+				require.Equal(t, "raw_items", m[semconv.DBCollectionNameKey].AsString())
+			},
+		},
 	}
 
 	for i, test := range tests {
@@ -222,6 +254,686 @@ func TestOtelPlugin_ContextRestoration(t *testing.T) {
 	require.Equal(t, origCtx, db.Statement.Context)
 }
 
+func TestDBStatsMetricsMeterProvider(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	db := openTestDB(t)
+	require.NoError(t, db.Use(NewPlugin(WithTracerProvider(noop.NewTracerProvider()), WithMeterProvider(meterProvider))))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	require.Equal(t, 1, len(rm.ScopeMetrics))
+	require.Equal(t, "go.sql.connections_max_open", rm.ScopeMetrics[0].Metrics[0].Name)
+}
+
+func TestPoolMetrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	pm, err := metrics.NewPoolMetrics(metrics.WithMeterProvider(meterProvider))
+	require.NoError(t, err)
+
+	db := openTestDB(t)
+	require.NoError(t, db.Use(NewPlugin(WithTracerProvider(noop.NewTracerProvider()), WithoutMetrics(), WithPoolMetrics(pm))))
+
+	type PoolItem struct {
+		ID   int
+		Name string
+	}
+	require.NoError(t, db.AutoMigrate(&PoolItem{}))
+
+	// collect returns the histogram counts and the transaction counts per outcome
+	collect := func() map[string]int64 {
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, reader.Collect(context.Background(), &rm))
+		counts := map[string]int64{}
+		for _, m := range rm.ScopeMetrics[0].Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Histogram[float64]:
+				counts[m.Name] = int64(data.DataPoints[0].Count)
+			case metricdata.Sum[int64]:
+				for _, point := range data.DataPoints {
+					outcome, _ := point.Attributes.Value("db.transaction.outcome")
+					counts[m.Name+outcome.AsString()] = point.Value
+				}
+			}
+		}
+		return counts
+	}
+	released := func(counts map[string]int64) bool {
+		return counts["db.client.connection.wait_time"] == counts["db.client.connection.use_time"]
+	}
+	require.Eventually(t, func() bool { return released(collect()) }, time.Second, 10*time.Millisecond)
+	before := collect()
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+
+	// queries and transactions return their connection before they return
+	require.NoError(t, db.Create(&PoolItem{Name: "a"}).Error)
+	require.Equal(t, 0, sqlDB.Stats().InUse)
+	var items []PoolItem
+	require.NoError(t, db.Find(&items).Error)
+	require.Equal(t, 0, sqlDB.Stats().InUse)
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		return tx.Create(&PoolItem{Name: "b"}).Error
+	}))
+	require.Equal(t, 0, sqlDB.Stats().InUse)
+	errRollback := fmt.Errorf("rollback")
+	require.ErrorIs(t, db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, tx.Create(&PoolItem{Name: "c"}).Error)
+		return errRollback
+	}), errRollback)
+	require.Equal(t, 0, sqlDB.Stats().InUse)
+	require.NotEmpty(t, items)
+
+	// 4 acquisitions: the create, the find and the two transactions
+	var after map[string]int64
+	require.Eventually(t, func() bool {
+		after = collect()
+		return released(after) && after["db.client.connection.wait_time"]-before["db.client.connection.wait_time"] == 4
+	}, time.Second, 10*time.Millisecond)
+
+	// gorm runs the create in a transaction by default
+	require.Equal(t, int64(3), after["db.client.transaction.duration"]-before["db.client.transaction.duration"])
+	require.Equal(t, int64(2), after["db.client.transactionscommit"]-before["db.client.transactionscommit"])
+	require.Equal(t, int64(1), after["db.client.transactionsrollback"]-before["db.client.transactionsrollback"])
+	require.Contains(t, after, "db.client.transaction.open")
+	require.Equal(t, int64(0), after["db.client.transaction.open"])
+}
+
+// BenchmarkPoolMetrics reports the allocations of a query acquired through the
+// pool metrics, and the goroutines still running once it has returned.
+func BenchmarkPoolMetrics(b *testing.B) {
+	pm, err := metrics.NewPoolMetrics(metrics.WithMeterProvider(sdkmetric.NewMeterProvider()))
+	require.NoError(b, err)
+
+	db := openTestDB(b)
+	require.NoError(b, db.Exec("CREATE TABLE bench_items (id INTEGER)").Error)
+	require.NoError(b, db.Exec("INSERT INTO bench_items VALUES (1)").Error)
+	require.NoError(b, db.Use(NewPlugin(WithTracerProvider(noop.NewTracerProvider()), WithoutMetrics(), WithPoolMetrics(pm))))
+
+	base := runtime.NumGoroutine()
+	var goroutines int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var ids []int
+		if err := db.Table("bench_items").Pluck("id", &ids).Error; err != nil {
+			b.Fatal(err)
+		}
+		goroutines += runtime.NumGoroutine() - base
+	}
+	b.ReportMetric(float64(goroutines)/float64(b.N), "goroutines/op")
+}
+
+func TestPoolMetricsPreparedStmt(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	pm, err := metrics.NewPoolMetrics(metrics.WithMeterProvider(meterProvider))
+	require.NoError(t, err)
+
+	db := openTestDB(t, &gorm.Config{PrepareStmt: true})
+	require.NoError(t, db.Exec("CREATE TABLE prepared_items (id INTEGER)").Error)
+	require.NoError(t, db.Use(NewPlugin(WithTracerProvider(noop.NewTracerProvider()), WithoutMetrics(), WithPoolMetrics(pm))))
+
+	require.NoError(t, db.Transaction(func(tx *gorm.DB) error {
+		return tx.Exec("INSERT INTO prepared_items VALUES (1)").Error
+	}))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	var transactions uint64
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if m.Name == "db.client.transaction.duration" {
+			transactions = m.Data.(metricdata.Histogram[float64]).DataPoints[0].Count
+		}
+	}
+	require.Equal(t, uint64(1), transactions)
+}
+
+func TestStartOptionsPerSession(t *testing.T) {
+	var calls int
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithServerAddressProvider(func(gorm.Dialector) string {
+		calls++
+		return "db.local"
+	}))
+
+	var num int
+	for i := 0; i < 10; i++ {
+		// every WithContext copies the *gorm.Config
+		require.NoError(t, db.WithContext(context.Background()).Raw("SELECT 1").Scan(&num).Error)
+	}
+	require.Equal(t, 1, calls)
+
+	spans := pt.spans.Ended()
+	require.Equal(t, 10, len(spans))
+	m := attrMap(spans[9].Attributes())
+	require.Equal(t, "db.local", m[semconv.ServerAddressKey].AsString())
+	require.Equal(t, trace.SpanKindClient, spans[9].SpanKind())
+}
+
+func TestPluginClose(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+
+	db := openTestDB(t)
+	p := NewPlugin(WithTracerProvider(noop.NewTracerProvider()), WithMeterProvider(meterProvider))
+	require.NoError(t, db.Use(p))
+	require.NoError(t, p.(io.Closer).Close())
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		require.Empty(t, sm.Metrics)
+	}
+}
+
+func TestNPlusOneThreshold(t *testing.T) {
+	for _, threshold := range []int{-1, 0, 1} {
+		d := newNPlusOneDetector(threshold)
+		parent := trace.SpanID{1}
+		_, detected := d.observe(parent, "SELECT ?")
+		require.False(t, detected, threshold)
+		_, detected = d.observe(parent, "SELECT ?")
+		require.True(t, detected, threshold)
+	}
+}
+
+func TestNPlusOneDetection(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithNPlusOneDetection(2), WithFingerprintMetricDimension())
+
+	ctx, parent := pt.provider.Tracer("test").Start(context.Background(), "parent")
+	for i := 0; i < 4; i++ {
+		var num int
+		err := db.WithContext(ctx).Raw("SELECT ?", i).Scan(&num).Error
+		require.NoError(t, err)
+	}
+	parent.End()
+
+	spans := pt.spans.Ended()
+	require.Equal(t, 5, len(spans))
+	events := spans[4].Events()
+	require.Equal(t, 1, len(events))
+	require.Equal(t, "db.n_plus_one", events[0].Name)
+	m := attrMap(events[0].Attributes)
+	require.Equal(t, "SELECT ?", m[semconv.DBQueryTextKey].AsString())
+	require.Equal(t, "199e7dca63ea8858", m[dbQueryFingerprint].AsString())
+	require.Equal(t, int64(3), m[dbQueryCount].AsInt64())
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, pt.reader.Collect(context.Background(), &rm))
+	require.Equal(t, 1, len(rm.ScopeMetrics))
+	require.Equal(t, "db.client.n_plus_one", rm.ScopeMetrics[0].Metrics[0].Name)
+	sum := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64])
+	require.Equal(t, int64(1), sum.DataPoints[0].Value)
+	fingerprint, _ := sum.DataPoints[0].Attributes.Value(dbQueryFingerprint)
+	require.Equal(t, "199e7dca63ea8858", fingerprint.AsString())
+	require.Equal(t, "199e7dca63ea8858", attrMap(spans[0].Attributes())[dbQueryFingerprint].AsString())
+}
+
+func TestSlowQuery(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithSlowThreshold(time.Nanosecond))
+
+	var num int
+	require.NoError(t, db.Raw("SELECT 42").Scan(&num).Error)
+
+	spans := pt.spans.Ended()
+	require.Equal(t, 1, len(spans))
+	events := spans[0].Events()
+	require.Equal(t, 1, len(events))
+	require.Equal(t, "db.slow_query", events[0].Name)
+	m := attrMap(events[0].Attributes)
+	require.Greater(t, m[dbQueryDuration].AsFloat64(), 0.0)
+	require.Equal(t, 1e-9, m[dbSlowThreshold].AsFloat64())
+	require.Contains(t, m, dbPoolInUse)
+	require.Contains(t, m, dbPoolWaitCount)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, pt.reader.Collect(context.Background(), &rm))
+	require.Equal(t, "db.client.slow_queries", rm.ScopeMetrics[0].Metrics[0].Name)
+	sum := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64])
+	require.Equal(t, int64(1), sum.DataPoints[0].Value)
+}
+
+func TestSlowQueryExplain(t *testing.T) {
+	db := openTestDB(t)
+
+	type ExplainItem struct {
+		ID   int
+		Name string
+	}
+	require.NoError(t, db.Migrator().AutoMigrate(&ExplainItem{}, &TenantAccount{}))
+	require.NoError(t, db.Exec("CREATE TABLE explain_logs (id INTEGER)").Error)
+
+	pt := usePlugin(t, db, WithSlowThreshold(time.Nanosecond), WithSlowQueryExplain(0))
+
+	var items []ExplainItem
+	require.NoError(t, db.Where("name = ?", "a").Find(&items).Error)
+	require.Eventually(t, func() bool { return len(pt.spans.Ended()) == 2 }, time.Second, 10*time.Millisecond)
+
+	spans := pt.spans.Ended()
+	require.Equal(t, "gorm.Explain", spans[1].Name())
+	require.Equal(t, spans[0].SpanContext(), spans[1].Links()[0].SpanContext)
+	m := attrMap(spans[1].Attributes())
+	require.True(t, strings.HasPrefix(m[semconv.DBQueryTextKey].AsString(), "EXPLAIN QUERY PLAN SELECT"))
+	require.Contains(t, m[dbQueryPlan].AsString(), "explain_items")
+	require.Equal(t, attrMap(spans[0].Attributes())[dbQueryFingerprint], m[dbQueryFingerprint])
+	require.Eventually(t, func() bool { return !pt.plugin.explain.running.Load() }, time.Second, 10*time.Millisecond)
+
+	// the cached plan is attached to later executions
+	require.NoError(t, db.Where("name = ?", "b").Find(&items).Error)
+	spans = pt.spans.Ended()
+	require.Equal(t, 3, len(spans))
+	events := spans[2].Events()
+	require.Equal(t, 2, len(events))
+	require.Equal(t, "db.query.plan", events[1].Name)
+	require.Contains(t, attrMap(events[1].Attributes)[dbQueryPlan].AsString(), "explain_items")
+
+	// only SELECTs are explained
+	require.NoError(t, db.Create(&ExplainItem{Name: "c"}).Error)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 4, len(pt.spans.Ended()))
+
+	// plans could show the bound values of redacted fields
+	var accounts []TenantAccount
+	require.NoError(t, db.Where("password = ?", "hunter2").Find(&accounts).Error)
+	time.Sleep(50 * time.Millisecond)
+	spans = pt.spans.Ended()
+	require.Equal(t, 5, len(spans))
+	require.Equal(t, 1, len(spans[4].Events()))
+	require.Equal(t, "db.slow_query", spans[4].Events()[0].Name)
+
+	// explaining a multi-statement query would run the trailing statements again
+	var ids []int
+	require.NoError(t, db.Raw("SELECT id FROM explain_items; INSERT INTO explain_logs VALUES (1)").Scan(&ids).Error)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 6, len(pt.spans.Ended()))
+	var logged int64
+	require.NoError(t, db.Table("explain_logs").Count(&logged).Error)
+	require.Equal(t, int64(1), logged)
+}
+
+func TestContextCancellation(t *testing.T) {
+	for _, ignoreCanceled := range []bool{false, true} {
+		var opts []Option
+		if ignoreCanceled {
+			opts = append(opts, WithoutCanceledErrors())
+		}
+		db := openTestDB(t)
+		pt := usePlugin(t, db, opts...)
+
+		var num int
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		require.NoError(t, db.WithContext(ctx).Raw("SELECT 1").Scan(&num).Error)
+		cancel()
+		require.Error(t, db.WithContext(ctx).Raw("SELECT 1").Scan(&num).Error)
+
+		ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		require.Error(t, db.WithContext(ctx).Raw("SELECT 1").Scan(&num).Error)
+		cancel()
+
+		spans := pt.spans.Ended()
+		require.Equal(t, 3, len(spans))
+
+		m := attrMap(spans[0].Attributes())
+		require.Greater(t, m[dbContextDeadline].AsFloat64(), 50.0)
+		require.NotContains(t, m, semconv.ErrorTypeKey)
+		require.Equal(t, codes.Unset, spans[0].Status().Code)
+
+		m = attrMap(spans[1].Attributes())
+		require.Equal(t, "canceled", m[semconv.ErrorTypeKey].AsString())
+		require.Equal(t, "canceled", m[dbContextCancellation].AsString())
+		if ignoreCanceled {
+			require.Equal(t, codes.Unset, spans[1].Status().Code)
+		} else {
+			require.Equal(t, codes.Error, spans[1].Status().Code)
+		}
+
+		m = attrMap(spans[2].Attributes())
+		require.Less(t, m[dbContextDeadline].AsFloat64(), 0.0)
+		require.Equal(t, "timeout", m[semconv.ErrorTypeKey].AsString())
+		require.Equal(t, "deadline_exceeded", m[dbContextCancellation].AsString())
+		require.Equal(t, codes.Error, spans[2].Status().Code)
+	}
+}
+
+func TestProfilerLabels(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithProfilerLabels())
+
+	labels := map[string]string{}
+	collect := func(tx *gorm.DB) {
+		pprof.ForLabels(tx.Statement.Context, func(key, value string) bool {
+			labels[key] = value
+			return true
+		})
+	}
+	require.NoError(t, db.Callback().Raw().After("otel:before:raw").Before("gorm:raw").Register("test:labels", collect))
+	require.NoError(t, db.Callback().Query().After("otel:before:select").Before("gorm:query").Register("test:labels", collect))
+
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("handler", "test"))
+	require.NoError(t, db.WithContext(ctx).Exec("CREATE TABLE IF NOT EXISTS label_items (id int)").Error)
+	spans := pt.spans.Ended()
+	require.Equal(t, "test", labels["handler"])
+	require.Equal(t, "create", labels["db.operation.name"])
+	require.Equal(t, attrMap(spans[0].Attributes())[dbQueryFingerprint].AsString(), labels["db.query.fingerprint"])
+	require.Equal(t, spans[0].SpanContext().TraceID().String(), labels["trace_id"])
+	require.Equal(t, spans[0].SpanContext().SpanID().String(), labels["span_id"])
+
+	clear(labels)
+	var ids []int
+	require.NoError(t, db.WithContext(ctx).Table("label_items").Pluck("id", &ids).Error)
+	require.Equal(t, "select", labels["db.operation.name"])
+	require.Equal(t, "label_items", labels["db.collection.name"])
+	require.NotContains(t, labels, "db.query.fingerprint")
+}
+
+func TestProfilerLabelsRestoration(t *testing.T) {
+	db := openTestDB(t)
+	usePlugin(t, db, WithProfilerLabels())
+
+	// labeled reports whether a goroutine carries the labels set by pprof.Do
+	labeled := func() bool {
+		var buf bytes.Buffer
+		require.NoError(t, pprof.Lookup("goroutine").WriteTo(&buf, 1))
+		return strings.Contains(buf.String(), `"handler":"test"`)
+	}
+
+	pprof.Do(context.Background(), pprof.Labels("handler", "test"), func(ctx context.Context) {
+		var num int
+		require.NoError(t, db.Raw("SELECT 1").Scan(&num).Error)
+		require.True(t, labeled())
+		require.NoError(t, db.WithContext(ctx).Raw("SELECT 1").Scan(&num).Error)
+		require.True(t, labeled())
+	})
+	require.False(t, labeled())
+}
+
+func TestQueryBudget(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithQueryBudgetEnforcement())
+
+	ctx, parent := pt.provider.Tracer("test").Start(context.Background(), "parent")
+	ctx = ContextWithQueryBudget(ctx, QueryBudget{MaxQueries: 2})
+
+	var num int
+	require.NoError(t, db.WithContext(ctx).Raw("SELECT 1").Scan(&num).Error)
+	require.NoError(t, db.WithContext(ctx).Raw("SELECT 2").Scan(&num).Error)
+	err := db.WithContext(ctx).Raw("SELECT 3").Scan(&num).Error
+	require.ErrorIs(t, err, ErrQueryBudgetExceeded)
+	parent.End()
+
+	spans := pt.spans.Ended()
+	require.Equal(t, 4, len(spans))
+	require.Equal(t, 0, len(spans[1].Events()))
+	require.Equal(t, "db.query_budget.exceeded", spans[2].Events()[0].Name)
+	require.Equal(t, codes.Error, spans[2].Status().Code)
+
+	m := attrMap(spans[3].Attributes())
+	require.Equal(t, int64(3), m[dbBudgetQueries].AsInt64())
+	require.Equal(t, []string{"queries"}, m[dbBudgetExceeded].AsStringSlice())
+}
+
+func TestQueryBudgetRefusesStatement(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.Exec("CREATE TABLE budget_items (id INTEGER)").Error)
+	usePlugin(t, db, WithQueryBudgetEnforcement())
+
+	ctx := ContextWithQueryBudget(context.Background(), QueryBudget{MaxQueries: 1})
+	require.NoError(t, db.WithContext(ctx).Exec("INSERT INTO budget_items VALUES (1)").Error)
+	err := db.WithContext(ctx).Exec("INSERT INTO budget_items VALUES (2)").Error
+	require.ErrorIs(t, err, ErrQueryBudgetExceeded)
+
+	// the refused statement was not executed
+	var count int64
+	require.NoError(t, db.Raw("SELECT count(*) FROM budget_items").Scan(&count).Error)
+	require.Equal(t, int64(1), count)
+
+	// the statement exhausting the rows budget completes, the next one is refused
+	require.NoError(t, db.Exec("INSERT INTO budget_items VALUES (2)").Error)
+	ctx = ContextWithQueryBudget(context.Background(), QueryBudget{MaxRows: 1})
+	var ids []int
+	require.NoError(t, db.WithContext(ctx).Table("budget_items").Pluck("id", &ids).Error)
+	require.Equal(t, []int{1, 2}, ids)
+	err = db.WithContext(ctx).Exec("INSERT INTO budget_items VALUES (3)").Error
+	require.ErrorIs(t, err, ErrQueryBudgetExceeded)
+	require.NoError(t, db.Raw("SELECT count(*) FROM budget_items").Scan(&count).Error)
+	require.Equal(t, int64(2), count)
+}
+
+func TestRowsIterationSpan(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithRowsIterationSpan())
+
+	rows, err := db.WithContext(context.Background()).Raw("SELECT 1 UNION ALL SELECT 2").Rows()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(pt.spans.Ended()))
+
+	var n int
+	for rows.Next() {
+		n++
+	}
+	require.Equal(t, 2, n)
+	require.NoError(t, rows.Close())
+
+	require.Eventually(t, func() bool { return len(pt.spans.Ended()) == 1 }, time.Second, time.Millisecond)
+	m := attrMap(pt.spans.Ended()[0].Attributes())
+	_, ok := m[dbRowsIterationDuration]
+	require.True(t, ok)
+
+	var num int
+	require.NoError(t, db.Raw("SELECT 42").Scan(&num).Error)
+	require.Equal(t, 42, num)
+	require.Eventually(t, func() bool { return len(pt.spans.Ended()) == 2 }, time.Second, time.Millisecond)
+
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	require.NotNil(t, sqlDB)
+}
+
+// callerRepository stands for an application helper issuing statements.
+func callerRepository(t *testing.T, db *gorm.DB) {
+	var num int
+	require.NoError(t, db.Raw("SELECT 42").Scan(&num).Error)
+}
+
+func TestCallerAttributes(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		var skipPrefixes []string
+		if skip {
+			skipPrefixes = append(skipPrefixes, "gorm.io/plugin/opentelemetry/tracing.callerRepository")
+		}
+		db := openTestDB(t)
+		pt := usePlugin(t, db, WithCallerAttributes(skipPrefixes...))
+
+		for i := 0; i < 2; i++ {
+			callerRepository(t, db)
+		}
+
+		function := "gorm.io/plugin/opentelemetry/tracing.callerRepository"
+		if skip {
+			function = "gorm.io/plugin/opentelemetry/tracing.TestCallerAttributes"
+		}
+
+		spans := pt.spans.Ended()
+		require.Equal(t, 2, len(spans))
+		for _, span := range spans {
+			m := attrMap(span.Attributes())
+			require.Equal(t, function, m[semconv.CodeFunctionNameKey].AsString())
+			require.True(t, strings.HasSuffix(m[semconv.CodeFilePathKey].AsString(), "tracing_test.go"))
+			require.NotZero(t, m[semconv.CodeLineNumberKey].AsInt64())
+		}
+	}
+}
+
+type SchemaUser struct {
+	ID        uint
+	Name      string
+	Password  string
+	DeletedAt gorm.DeletedAt
+}
+
+func TestSchemaAttributes(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.AutoMigrate(&SchemaUser{}))
+	pt := usePlugin(t, db, WithColumnSelectionAttributes())
+
+	var users []SchemaUser
+	require.NoError(t, db.Select("id", "name").Find(&users).Error)
+	require.NoError(t, db.Unscoped().Omit("password").Find(&users).Error)
+
+	spans := pt.spans.Ended()
+	require.Equal(t, 2, len(spans))
+
+	m := attrMap(spans[0].Attributes())
+	require.Equal(t, "tracing.SchemaUser", m[gormModelType].AsString())
+	require.Equal(t, []string{"ID"}, m[gormModelPrimaryKeys].AsStringSlice())
+	require.True(t, m[gormModelSoftDelete].AsBool())
+	require.Equal(t, []string{"id", "name"}, m[gormStatementSelects].AsStringSlice())
+
+	m = attrMap(spans[1].Attributes())
+	require.False(t, m[gormModelSoftDelete].AsBool())
+	require.Equal(t, []string{"password"}, m[gormStatementOmits].AsStringSlice())
+}
+
+type TenantAccount struct {
+	ID       uint
+	TenantID string `otel:"attr=tenant.id"`
+	Password string `otel:"redact"`
+}
+
+func (a *TenantAccount) OtelAttributes(ctx context.Context) []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("account.kind", "tenant")}
+}
+
+func TestModelAttributes(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.AutoMigrate(&TenantAccount{}))
+	pt := usePlugin(t, db)
+
+	account := &TenantAccount{TenantID: "acme", Password: "hunter2"}
+	require.NoError(t, db.Create(account).Error)
+	require.NoError(t, db.Model(account).Update("password", "s3cret").Error)
+
+	var found TenantAccount
+	require.NoError(t, db.Where("password = ?", "s3cret").First(&found).Error)
+	require.NoError(t, db.Where(&TenantAccount{Password: "s3cret"}).First(&found).Error)
+	require.NoError(t, db.Where(map[string]interface{}{"password": "s3cret"}).First(&found).Error)
+	require.NoError(t, db.Where("tenant_accounts.password IN ?", []string{"s3cret", "other"}).First(&found).Error)
+
+	spans := pt.spans.Ended()
+	require.Equal(t, 6, len(spans))
+
+	m := attrMap(spans[0].Attributes())
+	require.Equal(t, "acme", m["tenant.id"].AsString())
+	require.Equal(t, "tenant", m["account.kind"].AsString())
+	require.Contains(t, m[semconv.DBQueryTextKey].AsString(), redactedValue)
+	require.NotContains(t, m[semconv.DBQueryTextKey].AsString(), "hunter2")
+
+	for _, span := range spans[1:] {
+		m = attrMap(span.Attributes())
+		require.Contains(t, m[semconv.DBQueryTextKey].AsString(), redactedValue)
+		require.NotContains(t, m[semconv.DBQueryTextKey].AsString(), "s3cret")
+		require.NotContains(t, m[semconv.DBQueryTextKey].AsString(), "other")
+	}
+}
+
+func TestModelAttributesOfReads(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.AutoMigrate(&TenantAccount{}))
+	accounts := make([]TenantAccount, 1000)
+	for i := range accounts {
+		accounts[i] = TenantAccount{TenantID: "acme", Password: fmt.Sprint("p", i)}
+	}
+	// a fetched value that happens to equal a bound variable
+	accounts[0].Password = "acme"
+	require.NoError(t, db.CreateInBatches(accounts, 100).Error)
+	pt := usePlugin(t, db)
+
+	var found []TenantAccount
+	res := db.Where(&TenantAccount{TenantID: "acme"}).Find(&found)
+	require.NoError(t, res.Error)
+	require.Len(t, found, 1000)
+
+	m := attrMap(pt.spans.Ended()[0].Attributes())
+	require.Contains(t, m[semconv.DBQueryTextKey].AsString(), `"acme"`)
+	require.NotContains(t, m[semconv.DBQueryTextKey].AsString(), redactedValue)
+	require.Equal(t, "acme", m["tenant.id"].AsString())
+
+	// the fetched rows are not walked
+	allocs := testing.AllocsPerRun(10, func() {
+		_ = redactVars(res, res.Statement.Vars)
+		_ = modelAttributes(res)
+	})
+	require.Less(t, allocs, float64(20))
+}
+
+func TestClauseAttributes(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.AutoMigrate(&SchemaUser{}))
+	pt := usePlugin(t, db, WithClauseAttributes())
+
+	var users []SchemaUser
+	require.NoError(t, db.Where("name = ?", "foo").Order("id").Limit(10).Offset(5).Find(&users).Error)
+	require.NoError(t, db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Model(&SchemaUser{}).Update("name", "bar").Error)
+	require.NoError(t, db.Clauses(clause.OnConflict{DoNothing: true}).Create(&SchemaUser{Name: "baz"}).Error)
+
+	spans := pt.spans.Ended()
+	require.Equal(t, 3, len(spans))
+
+	m := attrMap(spans[0].Attributes())
+	require.Equal(t, int64(10), m[gormClauseLimit].AsInt64())
+	require.Equal(t, int64(5), m[gormClauseOffset].AsInt64())
+	require.True(t, m[gormClauseOrderBy].AsBool())
+	require.False(t, m[gormClauseWhereEmpty].AsBool())
+
+	m = attrMap(spans[1].Attributes())
+	require.True(t, m[gormClauseWhereEmpty].AsBool())
+
+	m = attrMap(spans[2].Attributes())
+	require.Equal(t, "do_nothing", m[gormClauseOnConflict].AsString())
+}
+
+// pluginTest records the spans and metrics of the statements of a database
+// instrumented with the plugin.
+type pluginTest struct {
+	plugin   *otelPlugin
+	spans    *tracetest.SpanRecorder
+	provider *sdktrace.TracerProvider
+	reader   *sdkmetric.ManualReader
+}
+
+// openTestDB opens a private in-memory database, so that tests do not see each
+// other's tables. Tables can be created before the plugin is installed.
+func openTestDB(t testing.TB, opts ...gorm.Option) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), opts...)
+	require.NoError(t, err)
+	// a private in-memory database lives in a single connection
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	return db
+}
+
+// usePlugin installs the plugin on db with a recording tracer provider, a meter
+// provider read by a manual reader, WithoutMetrics and opts.
+func usePlugin(t testing.TB, db *gorm.DB, opts ...Option) *pluginTest {
+	pt := &pluginTest{spans: tracetest.NewSpanRecorder(), reader: sdkmetric.NewManualReader()}
+	pt.provider = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(pt.spans))
+	meterProvider := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(pt.reader),
+		sdkmetric.WithExemplarFilter(exemplar.TraceBasedFilter),
+	)
+
+	opts = append([]Option{WithTracerProvider(pt.provider), WithMeterProvider(meterProvider), WithoutMetrics()}, opts...)
+	pt.plugin = NewPlugin(opts...).(*otelPlugin)
+	require.NoError(t, db.Use(pt.plugin))
+	return pt
+}
+
 func attrMap(attrs []attribute.KeyValue) map[attribute.Key]attribute.Value {
 	m := make(map[attribute.Key]attribute.Value, len(attrs))
 	for _, kv := range attrs {
@@ -229,3 +941,246 @@ func attrMap(attrs []attribute.KeyValue) map[attribute.Key]attribute.Value {
 	}
 	return m
 }
+
+func hookBenchmarkDB(tb testing.TB, opts ...Option) (*otelPlugin, *gorm.DB) {
+	db := openTestDB(tb)
+	p := NewPlugin(append([]Option{WithoutMetrics()}, opts...)...).(*otelPlugin)
+	tx := db.Session(&gorm.Session{Context: context.Background()})
+	tx.Statement.Table = "users"
+	tx.Statement.SQL.WriteString("SELECT * FROM `users` WHERE `users`.`id` = ? ORDER BY `users`.`id` LIMIT 1")
+	tx.Statement.Vars = []interface{}{42}
+	tx.Statement.RowsAffected = 1
+	return p, tx
+}
+
+func BenchmarkHooks(b *testing.B) {
+	recording := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(tracetest.NewSpanRecorder()))
+	benchmarks := map[string][]Option{
+		"noop":              {WithTracerProvider(noop.NewTracerProvider())},
+		"recording":         {WithTracerProvider(recording)},
+		"recording/no_vars": {WithTracerProvider(recording), WithoutQueryVariables()},
+	}
+	for name, opts := range benchmarks {
+		b.Run(name, func(b *testing.B) {
+			p, tx := hookBenchmarkDB(b, opts...)
+			before, after := p.before("gorm.Query", p.startOptions(tx)...), p.after()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				before(tx)
+				after(tx)
+			}
+		})
+	}
+}
+
+func TestHooksAllocations(t *testing.T) {
+	p, tx := hookBenchmarkDB(t, WithTracerProvider(noop.NewTracerProvider()))
+	before, after := p.before("gorm.Query", p.startOptions(tx)...), p.after()
+	before(tx)
+	after(tx)
+
+	// a non-recording span costs its context and the context wrapper
+	allocs := testing.AllocsPerRun(100, func() {
+		before(tx)
+		after(tx)
+	})
+	require.LessOrEqual(t, allocs, 2.0)
+}
+
+type sqlStateTestError string
+
+func (e sqlStateTestError) Error() string    { return "sql state " + string(e) }
+func (e sqlStateTestError) SQLState() string { return string(e) }
+
+func TestErrorType(t *testing.T) {
+	p := &otelPlugin{}
+	ctx := context.Background()
+	inner := &fs.PathError{Op: "open", Path: "db", Err: fs.ErrNotExist}
+	require.Equal(t, "*fs.PathError", p.errorType(ctx, fmt.Errorf("a: %w", fmt.Errorf("b: %w", inner))))
+	require.Equal(t, "40001", p.errorType(ctx, fmt.Errorf("query: %w", sqlStateTestError("40001"))))
+	require.Equal(t, "timeout", p.errorType(ctx, fmt.Errorf("query: %w", context.DeadlineExceeded)))
+}
+
+func TestErrorMetrics(t *testing.T) {
+	for _, custom := range []bool{false, true} {
+		opts := []Option{WithErrorMetrics()}
+		if custom {
+			opts = append(opts, WithErrorStatusCode(func(err error) (string, bool) {
+				return "1213", true
+			}))
+		}
+		db := openTestDB(t)
+		pt := usePlugin(t, db, opts...)
+		require.NoError(t, db.Callback().Query().Before("gorm:query").Register("test:error", func(tx *gorm.DB) {
+			if tx.Statement.Table == "failing" {
+				tx.AddError(fmt.Errorf("query: %w", sqlStateTestError("40001")))
+			}
+		}))
+
+		var nums []int
+		require.NoError(t, db.Raw("SELECT 1").Scan(&nums).Error)
+		require.Error(t, db.Table("failing").Select("1").Find(&nums).Error)
+		require.Error(t, db.Table("failing").Select("1").Find(&nums).Error)
+
+		code := "40001"
+		if custom {
+			code = "1213"
+		}
+
+		spans := pt.spans.Ended()
+		require.Equal(t, 3, len(spans))
+		m := attrMap(spans[2].Attributes())
+		require.Equal(t, code, m[semconv.DBResponseStatusCodeKey].AsString())
+		require.Equal(t, code, m[semconv.ErrorTypeKey].AsString())
+
+		var rm metricdata.ResourceMetrics
+		require.NoError(t, pt.reader.Collect(context.Background(), &rm))
+		require.Equal(t, "db.client.errors", rm.ScopeMetrics[0].Metrics[0].Name)
+		sum := rm.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64])
+		require.Equal(t, 1, len(sum.DataPoints))
+		require.Equal(t, int64(2), sum.DataPoints[0].Value)
+
+		m = attrMap(sum.DataPoints[0].Attributes.ToSlice())
+		require.Equal(t, code, m[semconv.DBResponseStatusCodeKey].AsString())
+		require.Equal(t, code, m[semconv.ErrorTypeKey].AsString())
+		require.Equal(t, "failing", m[semconv.DBCollectionNameKey].AsString())
+	}
+}
+
+func TestMetricAttributeNormalization(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db,
+		WithSlowThreshold(time.Nanosecond),
+		WithMetricTableNamePattern(regexp.MustCompile(`_\d{4}_\d{2}_\d{2}$`), "_yyyy_mm_dd"),
+		WithMetricAttributeLimit(2),
+		WithoutMetricAttributes(SlowQueriesMetricName, semconv.DBOperationNameKey),
+	)
+
+	var nums []int
+	for _, table := range []string{"events_2024_10_16", "events_2024_10_17", "users", "orders"} {
+		_ = db.Table(table).Select("1").Find(&nums).Error
+	}
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, pt.reader.Collect(context.Background(), &rm))
+
+	counts := map[string]int64{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		// the statements failed, but error metrics are not enabled
+		require.NotEqual(t, "db.client.errors", m.Name)
+		if m.Name != "db.client.slow_queries" {
+			continue
+		}
+		for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+			require.False(t, dp.Attributes.HasValue(semconv.DBOperationNameKey))
+			table, _ := dp.Attributes.Value(semconv.DBCollectionNameKey)
+			counts[table.AsString()] += dp.Value
+		}
+	}
+	require.Equal(t, map[string]int64{"events_yyyy_mm_dd": 2, "users": 1, "_other": 1}, counts)
+}
+
+func TestMetricCollectionNameOfRaw(t *testing.T) {
+	db := openTestDB(t)
+	require.NoError(t, db.Exec("CREATE TABLE raw_metric_items (id int)").Error)
+	pt := usePlugin(t, db, WithOperationMetrics())
+
+	var ids []int
+	require.NoError(t, db.Raw("SELECT id FROM raw_metric_items").Scan(&ids).Error)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, pt.reader.Collect(context.Background(), &rm))
+	var tables []string
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if m.Name == OperationDurationMetricName {
+			for _, dp := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+				table, _ := dp.Attributes.Value(semconv.DBCollectionNameKey)
+				tables = append(tables, table.AsString())
+			}
+		}
+	}
+	// the span and the metric agree on the table found in the SQL
+	span := attrMap(pt.spans.Ended()[0].Attributes())
+	require.Equal(t, []string{span[semconv.DBCollectionNameKey].AsString()}, tables)
+	require.Equal(t, []string{"raw_metric_items"}, tables)
+}
+
+func TestAttributeLimiter(t *testing.T) {
+	l := newAttributeLimiter(2)
+	require.Equal(t, "a", l.value(semconv.DBCollectionNameKey, "a"))
+	require.Equal(t, "b", l.value(semconv.DBCollectionNameKey, "b"))
+	require.Equal(t, otherValue, l.value(semconv.DBCollectionNameKey, "c"))
+	require.Equal(t, "a", l.value(semconv.DBCollectionNameKey, "a"))
+	require.Equal(t, "c", l.value(semconv.DBOperationNameKey, "c"))
+}
+
+func TestOperationMetrics(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithOperationMetrics())
+
+	type OperationItem struct {
+		ID   int
+		Name string
+	}
+	require.NoError(t, db.Migrator().AutoMigrate(&OperationItem{}))
+	require.NoError(t, db.Create(&[]OperationItem{{Name: "a"}, {Name: "b"}, {Name: "c"}}).Error)
+
+	var items []OperationItem
+	require.NoError(t, db.Find(&items).Error)
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, pt.reader.Collect(context.Background(), &rm))
+
+	histograms := map[string]metricdata.Aggregation{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		histograms[m.Name] = m.Data
+	}
+
+	var selects uint64
+	for _, dp := range histograms["db.client.operation.duration"].(metricdata.Histogram[float64]).DataPoints {
+		require.Equal(t, metrics.DurationBoundaries, dp.Bounds)
+		op, _ := dp.Attributes.Value(semconv.DBOperationNameKey)
+		table, _ := dp.Attributes.Value(semconv.DBCollectionNameKey)
+		if op.AsString() == "select" && table.AsString() == "operation_items" {
+			selects += dp.Count
+		}
+	}
+	require.Equal(t, uint64(1), selects)
+
+	rows := histograms["db.client.response.returned_rows"].(metricdata.Histogram[int64]).DataPoints
+	require.Equal(t, 1, len(rows))
+	require.Equal(t, metrics.RowBoundaries, rows[0].Bounds)
+	require.Equal(t, int64(3), rows[0].Sum)
+	table, _ := rows[0].Attributes.Value(semconv.DBCollectionNameKey)
+	require.Equal(t, "operation_items", table.AsString())
+}
+
+func TestOperationMetricsExemplars(t *testing.T) {
+	db := openTestDB(t)
+	pt := usePlugin(t, db, WithOperationMetrics())
+
+	ctx, parent := pt.provider.Tracer("test").Start(context.Background(), "parent")
+	var num int
+	require.NoError(t, db.WithContext(ctx).Raw("SELECT 42").Scan(&num).Error)
+	parent.End()
+
+	spans := pt.spans.Ended()
+	require.Equal(t, "gorm.Row", spans[0].Name())
+	statement := spans[0].SpanContext()
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, pt.reader.Collect(context.Background(), &rm))
+
+	var exemplars []metricdata.Exemplar[float64]
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		if m.Name == "db.client.operation.duration" {
+			exemplars = m.Data.(metricdata.Histogram[float64]).DataPoints[0].Exemplars
+		}
+	}
+	require.Equal(t, 1, len(exemplars))
+	traceID, spanID := statement.TraceID(), statement.SpanID()
+	require.Equal(t, traceID[:], exemplars[0].TraceID)
+	require.Equal(t, spanID[:], exemplars[0].SpanID)
+	require.NotEqual(t, parent.SpanContext().SpanID(), spanID)
+}